@@ -0,0 +1,41 @@
+// Package archive reads and writes the archive formats that iupload
+// can unpack on upload and produce on download.
+package archive
+
+import "strings"
+
+// Supported archive formats.
+const (
+	Zip    = "zip"
+	Tar    = "tar"
+	TarGz  = "tar.gz"
+	TarXz  = "tar.xz"
+	TarZst = "tar.zst"
+)
+
+// extensions maps file name extensions to archive formats. Longer
+// extensions come first so that ".tar.gz" wins over ".gz".
+var extensions = []struct {
+	ext, format string
+}{
+	{".tar.gz", TarGz},
+	{".tar.xz", TarXz},
+	{".tar.zst", TarZst},
+	{".tgz", TarGz},
+	{".txz", TarXz},
+	{".tzst", TarZst},
+	{".tar", Tar},
+	{".zip", Zip},
+}
+
+// Detect returns the format of the archive called name, judging by
+// its extension, or "" if it is not a supported archive.
+func Detect(name string) string {
+	lower := strings.ToLower(name)
+	for _, e := range extensions {
+		if strings.HasSuffix(lower, e.ext) {
+			return e.format
+		}
+	}
+	return ""
+}
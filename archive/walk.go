@@ -0,0 +1,138 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Header describes an entry of an archive.
+type Header struct {
+	// The name of the entry as stored in the archive. It is not
+	// sanitized in any way and may well be absolute or contain
+	// ".." elements.
+	Name string
+
+	// The type and permissions of the entry. Hard links have the
+	// fs.ModeIrregular bit set.
+	Mode fs.FileMode
+
+	// The size claimed by the archive, which need not be true.
+	Size int64
+
+	ModTime time.Time
+}
+
+// WalkFunc is called by Walk for every entry of an archive. For
+// regular files, r reads the contents of the entry; it must not
+// be used after WalkFunc returns. Returning an error stops Walk.
+type WalkFunc func(hdr Header, r io.Reader) error
+
+// Walk calls fn for every entry of the archive file called name,
+// which is in the given format, in the order they are stored.
+func Walk(name, format string, fn WalkFunc) error {
+	if format == Zip {
+		return walkZip(name, fn)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch format {
+	case Tar:
+	case TarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case TarXz:
+		if r, err = xz.NewReader(f); err != nil {
+			return err
+		}
+	case TarZst:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+	return walkTar(r, fn)
+}
+
+func walkTar(r io.Reader, fn WalkFunc) error {
+	tr := tar.NewReader(r)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		hdr := Header{
+			Name:    th.Name,
+			Mode:    th.FileInfo().Mode(),
+			Size:    th.Size,
+			ModTime: th.ModTime,
+		}
+		switch th.Typeflag {
+		case tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeLink:
+			hdr.Mode |= fs.ModeIrregular
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZip(name string, fn WalkFunc) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		hdr := Header{
+			Name:    zf.Name,
+			Mode:    zf.Mode(),
+			Size:    int64(zf.UncompressedSize64),
+			ModTime: zf.Modified,
+		}
+		if err := walkZipFile(zf, hdr, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkZipFile(zf *zip.File, hdr Header, fn WalkFunc) error {
+	if !hdr.Mode.IsRegular() {
+		return fn(hdr, nil)
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return fn(hdr, rc)
+}
@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Writer writes files into an archive. Nothing is buffered beyond
+// what the compressor needs, so archives can be streamed to clients
+// while they are being made.
+type Writer struct {
+	zw *zip.Writer
+	tw *tar.Writer
+	cw io.WriteCloser // compressor below tw, if any
+}
+
+// NewWriter returns a Writer writing an archive in the given
+// format to w.
+func NewWriter(w io.Writer, format string) (*Writer, error) {
+	switch format {
+	case Zip:
+		return &Writer{zw: zip.NewWriter(w)}, nil
+	case Tar:
+		return &Writer{tw: tar.NewWriter(w)}, nil
+	case TarGz:
+		cw := gzip.NewWriter(w)
+		return &Writer{tw: tar.NewWriter(cw), cw: cw}, nil
+	case TarXz:
+		cw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &Writer{tw: tar.NewWriter(cw), cw: cw}, nil
+	case TarZst:
+		cw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &Writer{tw: tar.NewWriter(cw), cw: cw}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q", format)
+}
+
+// AddDir adds an entry for the directory called name.
+func (aw *Writer) AddDir(name string, info fs.FileInfo) error {
+	name += "/"
+	if aw.zw != nil {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		_, err = aw.zw.CreateHeader(hdr)
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	return aw.tw.WriteHeader(hdr)
+}
+
+// AddFile adds the regular file called name, described by info,
+// with the contents read from r.
+func (aw *Writer) AddFile(name string, info fs.FileInfo, r io.Reader) error {
+	var w io.Writer
+	if aw.zw != nil {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		hdr.Method = zip.Deflate
+		if w, err = aw.zw.CreateHeader(hdr); err != nil {
+			return err
+		}
+	} else {
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if err := aw.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		w = aw.tw
+	}
+	// tar needs exactly as many bytes as announced in the header
+	n, err := io.Copy(w, io.LimitReader(r, info.Size()))
+	if err == nil && n != info.Size() {
+		err = fmt.Errorf("%s changed size while being archived", name)
+	}
+	return err
+}
+
+// Close finishes the archive. It does not close the underlying writer.
+func (aw *Writer) Close() error {
+	if aw.zw != nil {
+		return aw.zw.Close()
+	}
+	err := aw.tw.Close()
+	if aw.cw != nil {
+		err = errors.Join(err, aw.cw.Close())
+	}
+	return err
+}
+
+// ContentType returns the MIME type of archives in format.
+func ContentType(format string) string {
+	switch format {
+	case Zip:
+		return "application/zip"
+	case Tar:
+		return "application/x-tar"
+	case TarGz:
+		return "application/gzip"
+	case TarXz:
+		return "application/x-xz"
+	case TarZst:
+		return "application/zstd"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,82 @@
+// Package auth tells who is making a request, from the client
+// certificate presented over mutual TLS, and whether they may do
+// what they ask for.
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Fields of client certificates that users can be identified by.
+const (
+	FieldCommonName = "cn"
+	FieldEmail      = "email"
+	FieldDNS        = "dns"
+	FieldURI        = "uri"
+)
+
+// CheckField returns an error if field is not one of the fields
+// users can be identified by.
+func CheckField(field string) error {
+	switch field {
+	case "", FieldCommonName, FieldEmail, FieldDNS, FieldURI:
+		return nil
+	}
+	return fmt.Errorf("unknown certificate field %q", field)
+}
+
+// FromCertificate returns the name of the user holding cert, taken
+// from the given field: the common name of the subject by default,
+// or the first email address, DNS name or URI among the subject
+// alternative names.
+func FromCertificate(cert *x509.Certificate, field string) string {
+	switch field {
+	case FieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case FieldDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case FieldURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+type userKey struct{}
+
+// Identify returns r carrying the name of the user identified by
+// the verified client certificate of the request, if any.
+func Identify(r *http.Request, field string) *http.Request {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return r
+	}
+	user := FromCertificate(r.TLS.VerifiedChains[0][0], field)
+	if user == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+}
+
+// User returns the name of the user making the request, or "" for
+// anonymous clients.
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// Allowed reports whether user is one of users. An empty list lets
+// everyone in, anonymous clients included.
+func Allowed(user string, users []string) bool {
+	return len(users) == 0 || (user != "" && slices.Contains(users, user))
+}
@@ -0,0 +1,147 @@
+// Package certs provides the certificates the server uses for TLS:
+// a self-signed one made on first start, and the fingerprints that
+// clients can pin it by.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File names of the self-signed certificate and its key in the
+// directory they are kept in.
+const (
+	CertFile = "cert.pem"
+	KeyFile  = "key.pem"
+)
+
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// SelfSigned returns the files of the self-signed certificate kept
+// in dir, first making one valid for hosts if there is none or it
+// has expired. The certificate is always valid for localhost and
+// the host name of the machine.
+func SelfSigned(dir string, hosts []string) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, CertFile), filepath.Join(dir, KeyFile)
+	if cert, err := readCert(certFile); err == nil && time.Now().Before(cert.NotAfter) {
+		if _, err := os.Stat(keyFile); err == nil {
+			return certFile, keyFile, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"iupload"}, CommonName: "iupload self-signed"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	names := append([]string{"localhost", "127.0.0.1", "::1"}, hosts...)
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if name != "" {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return "", "", err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0o644); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// Fingerprints returns the SHA-256 fingerprint of the certificate in
+// certFile, in hex as browsers show it, and the pin of its public key
+// in the form curl --pinnedpubkey takes.
+func Fingerprints(certFile string) (fingerprint, pin string, err error) {
+	cert, err := readCert(certFile)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(cert.Raw)
+	hexSum := make([]string, len(sum))
+	for i, b := range sum {
+		hexSum[i] = fmt.Sprintf("%02X", b)
+	}
+	pubSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return strings.Join(hexSum, ":"), "sha256//" + base64.StdEncoding.EncodeToString(pubSum[:]), nil
+}
+
+// Pool returns a pool of the certificates in the PEM file name, such
+// as those of the authorities signing client certificates.
+func Pool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate found in " + name)
+	}
+	return pool, nil
+}
+
+// readCert reads the first certificate from the PEM file name.
+func readCert(name string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found in " + name)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return os.WriteFile(name, data, perm)
+}
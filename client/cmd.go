@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+// command is a subcommand of iupload that acts as a client.
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *Client, flags *flag.FlagSet, args []string) error
+	flags func(flags *flag.FlagSet)
+}
+
+var commands = map[string]*command{
+	"push": {
+		usage: "push [-r] [-conflict policy] local... [remote-dir]",
+		flags: func(flags *flag.FlagSet) {
+			flags.Bool("r", false, "push directories and their contents")
+			flags.String("conflict", "", "what to do about existing files: overwrite, reject, rename or keep-both (default: the server's)")
+		},
+		run: runPush,
+	},
+	"pull": {
+		usage: "pull [-r] remote... [local-dir]",
+		flags: func(flags *flag.FlagSet) {
+			flags.Bool("r", false, "pull directories and their contents")
+		},
+		run: runPull,
+	},
+	"ls": {
+		usage: "ls [-l] [remote-dir...]",
+		flags: func(flags *flag.FlagSet) {
+			flags.Bool("l", false, "show sizes and modification times")
+		},
+		run: runList,
+	},
+	"rm": {
+		usage: "rm [-r] remote...",
+		flags: func(flags *flag.FlagSet) {
+			flags.Bool("r", false, "remove directories and their contents")
+		},
+		run: runRemove,
+	},
+	"mkdir": {
+		usage: "mkdir remote-dir...",
+		run:   runMkdir,
+	},
+}
+
+// IsCommand reports whether name is one of the client commands.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// Main runs the client command given by args, the first of which is
+// its name, and returns the exit status.
+func Main(args []string) int {
+	name := args[0]
+	cmd := commands[name]
+	flags := flag.NewFlagSet("iupload "+name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: iupload %s\n", cmd.usage)
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", "", "client config file (default: $IUPLOAD_CLIENT_CONFIG or iupload/client.yaml in the user config directory)")
+	server := flags.String("server", "", "server URL (default: $IUPLOAD_URL or server in the client config)")
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	cfg, err := LoadConfig(*configFile)
+	if err == nil && *server != "" {
+		cfg.Server = *server
+	}
+	var c *Client
+	if err == nil {
+		c, err = New(cfg)
+	}
+	if err == nil {
+		// an interrupted transfer stops cleanly, so that it can be
+		// resumed
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err = cmd.run(ctx, c, flags, flags.Args())
+		stop()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "iupload %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// flagValue returns the value of the flag called name.
+func flagValue[T any](flags *flag.FlagSet, name string) T {
+	return flags.Lookup(name).Value.(flag.Getter).Get().(T)
+}
+
+var errUsage = errors.New("missing arguments; see -h")
+
+func runPush(ctx context.Context, c *Client, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	recursive := flagValue[bool](flags, "r")
+	conflict := flagValue[string](flags, "conflict")
+	dir := "/"
+	if len(args) > 1 {
+		dir, args = args[len(args)-1], args[:len(args)-1]
+	}
+	for _, local := range args {
+		info, err := os.Stat(local)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err := c.Push(ctx, local, dir, conflict); err != nil {
+				return err
+			}
+			continue
+		}
+		if !recursive {
+			return fmt.Errorf("%s is a directory; use -r to push it", local)
+		}
+		root := path.Join(dir, filepath.Base(filepath.Clean(local)))
+		err = filepath.WalkDir(local, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(local, name)
+			if err != nil {
+				return err
+			}
+			remote := path.Join(root, filepath.ToSlash(rel))
+			if entry.IsDir() {
+				// created here so that empty directories come along too
+				return c.Mkdir(ctx, remote)
+			}
+			if !entry.Type().IsRegular() {
+				fmt.Fprintf(os.Stderr, "skipping %s: not a regular file\n", name)
+				return nil
+			}
+			return c.Push(ctx, name, path.Dir(remote), conflict)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPull(ctx context.Context, c *Client, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	recursive := flagValue[bool](flags, "r")
+	dir := "."
+	if len(args) > 1 {
+		dir, args = args[len(args)-1], args[:len(args)-1]
+	}
+	for _, remote := range args {
+		entry, err := c.Stat(ctx, remote)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir && !recursive {
+			return fmt.Errorf("%s is a directory; use -r to pull it", remote)
+		}
+		name := path.Base(path.Clean("/" + remote))
+		if name == "/" {
+			name = "."
+		}
+		if err := c.pull(ctx, remote, filepath.Join(dir, name), entry.IsDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pull downloads the file or, with its contents, the directory remote
+// to local.
+func (c *Client) pull(ctx context.Context, remote, local string, isDir bool) error {
+	if !isDir {
+		return c.Pull(ctx, remote, local)
+	}
+	if err := os.MkdirAll(local, 0o755); err != nil {
+		return err
+	}
+	entries, err := c.List(ctx, remote)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := c.pull(ctx, path.Join(remote, e.Name), filepath.Join(local, e.Name), e.IsDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runList(ctx context.Context, c *Client, flags *flag.FlagSet, args []string) error {
+	long := flagValue[bool](flags, "l")
+	if len(args) == 0 {
+		args = []string{"/"}
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	for i, dir := range args {
+		entries, err := c.List(ctx, dir)
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintf(tw, "%s:\n", dir)
+		}
+		for _, e := range entries {
+			name := e.Name
+			if e.IsDir {
+				name += "/"
+			}
+			if !long {
+				fmt.Fprintln(tw, name)
+				continue
+			}
+			size := "-"
+			if !e.IsDir {
+				size = humanize.IBytes(uint64(e.Size))
+			}
+			fmt.Fprintf(tw, "%9s\t%s\t%s\n", size, e.ModTime.Local().Format("2006-01-02 15:04"), name)
+		}
+	}
+	return nil
+}
+
+func runRemove(ctx context.Context, c *Client, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	return c.Remove(ctx, args, flagValue[bool](flags, "r"))
+}
+
+func runMkdir(ctx context.Context, c *Client, flags *flag.FlagSet, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	for _, dir := range args {
+		if err := c.Mkdir(ctx, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"errors"
+	"io/fs"
+	"iupload/config"
+	"os"
+	"path/filepath"
+)
+
+// Config tells the client which server to talk to, and how.
+type Config struct {
+	// The URL of the server, including the base path it is reached
+	// under, if any, such as "https://tools.example.internal/files".
+	Server string `json:"server"`
+
+	// PEM files with the client certificate and its key, for servers
+	// that require mutual TLS.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// A PEM file with the certificates of the authorities to trust
+	// for the server, such as the cert.pem of a self-signed server.
+	// Default: the system's
+	CA string `json:"ca,omitempty"`
+
+	// The pin of the public key of the server, in the form
+	// "sha256//...", as the server prints it at startup. A server with
+	// this key is trusted whoever signed its certificate.
+	Pin string `json:"pin,omitempty"`
+
+	// Credentials for basic authentication by a reverse proxy in
+	// front of the server. The server itself ignores them: it knows
+	// users only by their client certificates.
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// environment maps the environment variables that override settings
+// of the config file to the settings.
+var environment = []struct {
+	name  string
+	value func(c *Config) *string
+}{
+	{"IUPLOAD_URL", func(c *Config) *string { return &c.Server }},
+	{"IUPLOAD_CERT", func(c *Config) *string { return &c.Cert }},
+	{"IUPLOAD_KEY", func(c *Config) *string { return &c.Key }},
+	{"IUPLOAD_CA", func(c *Config) *string { return &c.CA }},
+	{"IUPLOAD_PIN", func(c *Config) *string { return &c.Pin }},
+	{"IUPLOAD_USER", func(c *Config) *string { return &c.User }},
+	{"IUPLOAD_PASSWORD", func(c *Config) *string { return &c.Password }},
+}
+
+// LoadConfig reads the client configuration from the JSON or YAML
+// file called name and overrides it with the environment. Without
+// a name, the file comes from IUPLOAD_CLIENT_CONFIG or else is
+// iupload/client.yaml in the user's config directory, which need
+// not exist.
+func LoadConfig(name string) (*Config, error) {
+	cfg := &Config{}
+	optional := false
+	if name == "" {
+		name = os.Getenv("IUPLOAD_CLIENT_CONFIG")
+	}
+	if name == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			name, optional = filepath.Join(dir, "iupload", "client.yaml"), true
+		}
+	}
+	if name != "" {
+		err := config.DecodeFile(name, cfg)
+		if err != nil && !(optional && errors.Is(err, fs.ErrNotExist)) {
+			return nil, err
+		}
+	}
+	for _, env := range environment {
+		if value, ok := os.LookupEnv(env.name); ok {
+			*env.value(cfg) = value
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// progressWidth is the width of the bar, in characters.
+const progressWidth = 24
+
+// progress shows how far a transfer has got. On a terminal, a bar is
+// redrawn in place as bytes are written to it; elsewhere, a single
+// line is printed when the transfer is done.
+type progress struct {
+	out      io.Writer
+	terminal bool
+	name     string
+	total    int64 // -1 if unknown
+	done     int64
+	resumed  int64 // done before this run
+	start    time.Time
+	drawn    time.Time
+}
+
+// newProgress returns the progress of transferring name, of which
+// done out of total bytes have been transferred already.
+func newProgress(name string, total, done int64) *progress {
+	terminal := false
+	if info, err := os.Stderr.Stat(); err == nil {
+		terminal = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &progress{
+		out:      os.Stderr,
+		terminal: terminal,
+		name:     name,
+		total:    total,
+		done:     done,
+		resumed:  done,
+		start:    time.Now(),
+	}
+}
+
+// Write counts the bytes in p as transferred.
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.terminal && time.Since(p.drawn) >= 100*time.Millisecond {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+// draw redraws the line of the transfer.
+func (p *progress) draw() {
+	p.drawn = time.Now()
+	bar, percent := "", ""
+	if p.total > 0 {
+		filled := int(p.done * progressWidth / p.total)
+		bar = "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled) + "] "
+		percent = fmt.Sprintf("%3d%% ", p.done*100/p.total)
+	}
+	fmt.Fprintf(p.out, "\r%s %s%s%s %s/s\033[K", p.name, bar, percent, humanize.IBytes(uint64(p.done)), humanize.IBytes(uint64(p.rate())))
+}
+
+// rate returns the bytes transferred per second in this run.
+func (p *progress) rate() float64 {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.done-p.resumed) / elapsed
+}
+
+// finish ends the line of the transfer.
+func (p *progress) finish(err error) {
+	if p.terminal {
+		p.draw()
+		fmt.Fprintln(p.out)
+		return
+	}
+	if err == nil {
+		resumed := ""
+		if p.resumed > 0 {
+			resumed = fmt.Sprintf(", resumed at %s", humanize.IBytes(uint64(p.resumed)))
+		}
+		fmt.Fprintf(p.out, "%s: %s in %s%s\n", p.name, humanize.IBytes(uint64(p.done)), time.Since(p.start).Round(time.Millisecond), resumed)
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iupload/digest"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// Pull downloads the file called name on the server to the local file
+// called local. The download goes to local+".part" first, which is
+// carried on from where it stopped if it is there already; the partial
+// file keeps the modification time of the file on the server, so that
+// a file changed in the meantime is downloaded afresh. Digests that
+// the server announces are checked before the file is put in place.
+func (c *Client) Pull(ctx context.Context, name, local string) error {
+	part := local + ".part"
+	var offset int64
+	var modTime time.Time
+	if info, err := os.Stat(part); err == nil {
+		offset, modTime = info.Size(), info.ModTime()
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/_download", url.Values{"file": {path.Clean("/" + name)}}, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", modTime.UTC().Format(http.TimeFormat))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file may be complete already, if it is as
+		// long as the file on the server; otherwise start over
+		if resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", offset) {
+			resp.Body.Close()
+			if err := os.Remove(part); err != nil {
+				return err
+			}
+			return c.Pull(ctx, name, local)
+		}
+		resp.Body = http.NoBody
+		flags |= os.O_APPEND
+	default:
+		return responseError(resp)
+	}
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	f, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	total := resp.ContentLength
+	if total >= 0 {
+		total += offset
+	}
+	bar := newProgress(name, total, offset)
+	_, err = io.Copy(f, io.TeeReader(resp.Body, bar))
+	bar.finish(err)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if !lastModified.IsZero() {
+		os.Chtimes(part, lastModified, lastModified)
+	}
+	if err != nil {
+		return err
+	}
+
+	if value := resp.Header.Get("Repr-Digest"); value != "" {
+		if err := verify(part, value); err != nil {
+			os.Remove(part)
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return os.Rename(part, local)
+}
+
+// verify checks the file called name against the digests given in a
+// Repr-Digest field value.
+func verify(name, value string) error {
+	expected, err := digest.ParseHeader(value)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sums, err := digest.Sum(f)
+	if err != nil {
+		return err
+	}
+	return sums.Verify(expected)
+}
@@ -0,0 +1,235 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tusVersion is the version of the tus protocol spoken with the server.
+const tusVersion = "1.0.0"
+
+// Push uploads the local file called name into the directory dir on
+// the server, with the conflict policy given, if any. It speaks the
+// tus protocol, so an upload cut short is resumed by pushing the same
+// file again.
+func (c *Client) Push(ctx context.Context, name, dir, conflict string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+
+	key, err := c.resumeKey(name, dir, info)
+	if err != nil {
+		return err
+	}
+	location, offset := c.resumable(ctx, key)
+	if location == "" {
+		if location, err = c.createUpload(ctx, info, dir, conflict); err != nil {
+			return err
+		}
+		if info.Size() > 0 {
+			remember(key, location)
+		}
+	}
+
+	bar := newProgress(name, info.Size(), offset)
+	for attempt := 0; info.Size() > 0; attempt++ {
+		err = c.patchUpload(ctx, location, f, offset, info.Size(), bar)
+		var se *StatusError
+		if attempt == busyRetries || !errors.As(err, &se) || se.StatusCode != http.StatusConflict {
+			break
+		}
+		// the server may not have noticed yet that an earlier
+		// attempt went away; ask it again where to go on from
+		time.Sleep(time.Second)
+		if location, offset = c.resumable(ctx, key); location == "" {
+			break
+		}
+		bar.done = offset
+	}
+	bar.finish(err)
+	if err != nil {
+		return err
+	}
+	forget(key)
+	return nil
+}
+
+// busyRetries is how many times an upload that the server reports
+// busy, or at another offset, is tried again.
+const busyRetries = 3
+
+// createUpload creates an upload for the file described by info on
+// the server, and returns its URL.
+func (c *Client) createUpload(ctx context.Context, info fs.FileInfo, dir, conflict string) (string, error) {
+	query := url.Values{"dir": {dir}}
+	if conflict != "" {
+		query.Set("conflict", conflict)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/_upload", query, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(info.Size(), 10))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(info.Name())))
+	resp, err := c.do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		return "", fmt.Errorf("creating upload: %v", err)
+	}
+	return location.String(), nil
+}
+
+// patchUpload sends the file f from offset on to the upload at
+// location, which is size bytes long in all.
+func (c *Client) patchUpload(ctx context.Context, location string, f *os.File, offset, size int64, bar *progress) error {
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := c.newRequestURL(ctx, http.MethodPatch, location, io.TeeReader(f, bar))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size - offset
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Upload-Offset"); got != strconv.FormatInt(size, 10) {
+		return fmt.Errorf("upload incomplete at offset %s; push again to resume", got)
+	}
+	return nil
+}
+
+// resumable returns the URL of the upload remembered under key and
+// the offset to resume it from, if the server still has it.
+func (c *Client) resumable(ctx context.Context, key string) (string, int64) {
+	location := remembered(key)
+	if location == "" {
+		return "", 0
+	}
+	req, err := c.newRequestURL(ctx, http.MethodHead, location, nil)
+	if err != nil {
+		return "", 0
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	resp, err := c.do(req)
+	if err != nil {
+		// gone, or expired; start over
+		var se *StatusError
+		if errors.As(err, &se) {
+			forget(key)
+		}
+		return "", 0
+	}
+	resp.Body.Close()
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		forget(key)
+		return "", 0
+	}
+	return location, offset
+}
+
+// resumeKey returns the key that an upload of the file called name,
+// described by info, into dir is remembered under. It changes with
+// the file, so that a modified file is uploaded afresh.
+func (c *Client) resumeKey(name, dir string, info fs.FileInfo) (string, error) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s %s %d %d", c.base, path.Clean("/"+dir), abs, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// The URLs of uploads in progress are kept in a file in the user's
+// cache directory, by resume key.
+var resumeMu sync.Mutex
+
+func resumeFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "iupload", "uploads.json")
+}
+
+func loadResume() map[string]string {
+	uploads := make(map[string]string)
+	if data, err := os.ReadFile(resumeFile()); err == nil {
+		json.Unmarshal(data, &uploads)
+	}
+	return uploads
+}
+
+func saveResume(uploads map[string]string) {
+	name := resumeFile()
+	if name == "" {
+		return
+	}
+	data, err := json.MarshalIndent(uploads, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(name), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(name, data, 0o600)
+	}
+	if err != nil {
+		// uploads still work, they just can't be resumed
+		fmt.Fprintf(os.Stderr, "saving upload state: %v\n", err)
+	}
+}
+
+func remembered(key string) string {
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	return loadResume()[key]
+}
+
+func remember(key, location string) {
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	uploads := loadResume()
+	uploads[key] = location
+	saveResume(uploads)
+}
+
+func forget(key string) {
+	resumeMu.Lock()
+	defer resumeMu.Unlock()
+	uploads := loadResume()
+	if _, ok := uploads[key]; ok {
+		delete(uploads, key)
+		saveResume(uploads)
+	}
+}
@@ -0,0 +1,538 @@
+// Package config assembles the configuration of the server from
+// defaults, a JSON or YAML config file, environment variables and
+// command-line flags, each overriding the ones before.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"iupload/auth"
+	"iupload/fileserver"
+	"iupload/listen"
+	"iupload/mount"
+	"iupload/throttle"
+	"iupload/upload"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the server. The settings of the
+// served files, such as root, index_names and browse, sit at the
+// top level of config files.
+type Config struct {
+	// The addresses to listen on: TCP addresses such as ":44321",
+	// Unix domain sockets such as "unix:/run/iupload.sock", and
+	// "systemd:" or "systemd:name" for sockets passed by systemd.
+	// A single address may be given as a string. Default: ":44321"
+	Listen List `json:"listen,omitempty"`
+
+	// The permissions of Unix domain sockets, such as "0660".
+	// Default: as the umask leaves them
+	SocketMode FileMode `json:"socket_mode,omitempty"`
+
+	// The path the server is reached under through a reverse proxy
+	// that passes it on, such as "/files". Requests for other paths
+	// are not served. Proxies that strip the path instead can send
+	// it in the X-Forwarded-Prefix header. Default: none
+	BasePath string `json:"base_path,omitempty"`
+
+	// The reverse proxies trusted to send the X-Forwarded-Prefix and
+	// X-Forwarded-Proto headers: addresses such as "127.0.0.1",
+	// networks such as "10.0.0.0/8", and "unix" for connections over
+	// Unix domain sockets. Default: none
+	TrustedProxies List `json:"trusted_proxies,omitempty"`
+
+	// The directory the server keeps its own state in, such as the
+	// secret that links are signed with and the shares. It must not
+	// be inside a served directory, where uploads could replace it.
+	// Default: "iupload" in the user's configuration directory
+	DataDir string `json:"data_dir,omitempty"`
+
+	// Run the router in debug mode, with verbose logging.
+	Debug bool `json:"debug,omitempty"`
+
+	// How long to let transfers in progress finish when the server is
+	// asked to stop, before cutting them short. Default: "30s"
+	ShutdownTimeout Duration `json:"shutdown_timeout,omitempty"`
+
+	// Serve HTTPS instead of plain HTTP.
+	TLS *TLS `json:"tls,omitempty"`
+
+	// What clients may do: "read-write", "read-only" to only serve
+	// files, or "drop-box" to only accept uploads, without listing or
+	// serving what is there. Mounts default to it.
+	// Default: "read-write"
+	Mode string `json:"mode,omitempty"`
+
+	// The users, identified by their client certificates, who may
+	// list and revoke the shares of others. Everyone else only
+	// manages the shares they made.
+	Admins []string `json:"admins,omitempty"`
+
+	fileserver.FileServer
+
+	// Settings for uploads. Files are always uploaded to the root.
+	Upload *upload.Upload `json:"upload,omitempty"`
+
+	// Bandwidth limits.
+	Throttle *throttle.Throttle `json:"throttle,omitempty"`
+
+	// Directories to serve under paths of their own, in place of
+	// the root. The top level then lists the mounts.
+	Mounts []*Mount `json:"mounts,omitempty"`
+}
+
+// TLS configures HTTPS.
+type TLS struct {
+	// Files with the PEM-encoded certificate chain and private key.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// Without Cert and Key, make a self-signed certificate on first
+	// start and keep it in the data directory.
+	SelfSigned bool `json:"self_signed,omitempty"`
+
+	// Further host names and IP addresses the self-signed certificate
+	// is valid for, besides localhost and the name of the machine.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// A PEM file with the certificates of the authorities that sign
+	// client certificates. If set, clients must present a certificate
+	// signed by one of them, and are known by the user it names.
+	ClientCA string `json:"client_ca,omitempty"`
+
+	// The field of client certificates that names the user: "cn" for
+	// the common name of the subject, or "email", "dns" or "uri" for
+	// the first subject alternative name of that type. Default: "cn"
+	UserField string `json:"user_field,omitempty"`
+}
+
+// Enabled reports whether t asks for HTTPS.
+func (t *TLS) Enabled() bool {
+	return t != nil && (t.Cert != "" || t.SelfSigned)
+}
+
+// validate ensures t is a valid TLS configuration.
+func (t *TLS) validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("cert and key must be given together")
+	}
+	if t.Cert != "" && t.SelfSigned {
+		return errors.New("self_signed and cert exclude each other")
+	}
+	if t.ClientCA != "" && !t.Enabled() {
+		return errors.New("client_ca needs cert and key or self_signed")
+	}
+	if err := auth.CheckField(t.UserField); err != nil {
+		return err
+	}
+	for _, name := range []string{t.Cert, t.Key, t.ClientCA} {
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mount is a directory served under a path of its own. Its file
+// server settings sit at the top level of the mount, as they do for
+// the root.
+type Mount struct {
+	// The path the mount appears under, such as "builds".
+	Path string `json:"path"`
+
+	// What clients may do with the mount, as with the mode of the
+	// server, which it defaults to.
+	Mode string `json:"mode,omitempty"`
+
+	fileserver.FileServer
+
+	// Settings for uploads into the mount. Without them, the mount
+	// is read-only.
+	Upload *upload.Upload `json:"upload,omitempty"`
+}
+
+// UnmarshalJSON decodes a mount, starting from the defaults for the
+// files served.
+func (m *Mount) UnmarshalJSON(data []byte) error {
+	type plain Mount
+	*m = Mount{FileServer: Default().FileServer}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(m))
+}
+
+// Duration is a time.Duration written as a string such as "30s" or
+// "5m" in config files.
+type Duration time.Duration
+
+// UnmarshalJSON decodes a duration from a string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// List is a list of strings that may be written as a single string
+// in config files.
+type List []string
+
+// UnmarshalJSON decodes a list from a string or a list of strings.
+func (l *List) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = List{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// FileMode is a fs.FileMode written in octal, such as "0660", in
+// config files.
+type FileMode fs.FileMode
+
+// UnmarshalJSON decodes permissions from an octal string or from a
+// number, as YAML has it for unquoted octal numbers.
+func (m *FileMode) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n uint32
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("permissions must be an octal string such as \"0660\"")
+		}
+		*m = FileMode(n)
+		return nil
+	}
+	return m.parse(s)
+}
+
+// parse parses permissions in octal.
+func (m *FileMode) parse(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid permissions %q", s)
+	}
+	*m = FileMode(n)
+	return nil
+}
+
+// Default returns the configuration used where nothing else is set.
+func Default() *Config {
+	return &Config{
+		Listen:          List{":44321"},
+		ShutdownTimeout: Duration(30 * time.Second),
+		FileServer: fileserver.FileServer{
+			Root:          "static",
+			IndexNames:    []string{"index.html"},
+			Browse:        &fileserver.Browse{},
+			Precompressed: []string{"br", "zstd", "gzip"},
+			Compress:      true,
+			InlineExtensions: []string{
+				".pdf", ".png", ".jpg", ".jpeg", ".gif", ".webp",
+				".txt", ".log", ".mp4", ".mp3",
+			},
+		},
+		Upload: &upload.Upload{
+			MinFreeSpace: 1 << 30,
+		},
+		Throttle: &throttle.Throttle{},
+	}
+}
+
+// Load builds the configuration from the command-line arguments
+// args, the environment and the config file named by the -config
+// flag or the IUPLOAD_CONFIG variable, and validates it. It returns
+// flag.ErrHelp if help was asked for.
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("iupload", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("IUPLOAD_CONFIG"),
+		"JSON or YAML config `file` (env IUPLOAD_CONFIG)")
+	set := make(map[string]string)
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		record := func(value string) error {
+			set[s.name] = value
+			return nil
+		}
+		if s.isBool {
+			flags.BoolFunc(s.name, usage, record)
+		} else {
+			flags.Func(s.name, usage, record)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	cfg := Default()
+	if *configFile != "" {
+		if err := cfg.ReadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Upload == nil {
+		cfg.Upload = &upload.Upload{}
+	}
+	if cfg.Throttle == nil {
+		cfg.Throttle = &throttle.Throttle{}
+	}
+	for _, s := range settings {
+		value, ok := set[s.name]
+		if !ok {
+			value, ok = os.LookupEnv(s.env)
+		}
+		if !ok {
+			continue
+		}
+		if err := s.apply(cfg, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %v", value, s.name, err)
+		}
+	}
+	cfg.fillDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ReadFile reads the config file called name into c.
+func (c *Config) ReadFile(name string) error {
+	return DecodeFile(name, c)
+}
+
+// DecodeFile decodes the config file called name into v. Files ending
+// in .yaml or .yml are YAML, anything else JSON. Both use the json
+// tags of v; unknown keys are an error, so typos don't go unnoticed.
+func DecodeFile(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		// the structs only carry json tags, so go through JSON
+		var doc any
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("parsing %s: %v", name, err)
+		}
+		if doc == nil {
+			return nil
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return fmt.Errorf("parsing %s: %v", name, err)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("parsing %s: %v", name, err)
+	}
+	return nil
+}
+
+// fillDefaults fills in what depends on other settings.
+func (c *Config) fillDefaults() {
+	c.Upload.Root = c.Root
+	for _, m := range c.Mounts {
+		if m.Upload != nil {
+			m.Upload.Root = m.Root
+		}
+		if m.Mode == "" {
+			m.Mode = c.Mode
+		}
+	}
+	if c.DataDir == "" {
+		c.DataDir = defaultDataDir()
+	}
+}
+
+// defaultDataDir returns the directory the server keeps its own state
+// in unless told otherwise: "iupload" in the user's configuration
+// directory, such as ~/.config/iupload, or ".iupload" in the working
+// directory if there is no such directory.
+func defaultDataDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".iupload"
+	}
+	return filepath.Join(dir, "iupload")
+}
+
+// checkDataDir ensures that the data directory is not inside the
+// served directory root, where uploads could replace the secret
+// links are signed with or the shares.
+func (c *Config) checkDataDir(root string) error {
+	if inside(c.DataDir, root) {
+		return fmt.Errorf("data_dir %s is inside the served directory %s; move it elsewhere", c.DataDir, root)
+	}
+	return nil
+}
+
+// inside reports whether dir is root or below it, after following
+// symbolic links in the parts of both that exist.
+func inside(dir, root string) bool {
+	dir, root = realPath(dir), realPath(root)
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// realPath returns name as an absolute path with symbolic links
+// resolved, as far as it exists.
+func realPath(name string) string {
+	name, err := filepath.Abs(name)
+	if err != nil {
+		return name
+	}
+	var missing []string
+	for {
+		if real, err := filepath.EvalSymlinks(name); err == nil {
+			return filepath.Join(append([]string{real}, missing...)...)
+		}
+		parent := filepath.Dir(name)
+		if parent == name {
+			return name
+		}
+		missing = append([]string{filepath.Base(name)}, missing...)
+		name = parent
+	}
+}
+
+// Validate ensures c is a valid configuration.
+func (c *Config) Validate() error {
+	if len(c.Listen) == 0 {
+		return errors.New("no listen address given")
+	}
+	for _, addr := range c.Listen {
+		if err := listen.Check(addr); err != nil {
+			return fmt.Errorf("listen: %v", err)
+		}
+	}
+	if c.BasePath != "" && !strings.HasPrefix(c.BasePath, "/") {
+		return fmt.Errorf("base_path %q must start with /", c.BasePath)
+	}
+	if _, err := fileserver.ParseProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+	if c.SocketMode&^FileMode(fs.ModePerm) != 0 {
+		return fmt.Errorf("socket_mode: invalid permissions %#o", c.SocketMode)
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout must not be negative")
+	}
+	if c.TLS != nil {
+		if err := c.TLS.validate(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	if err := mount.CheckMode(c.Mode); err != nil {
+		return err
+	}
+	if err := c.checkSignedOnly(&c.FileServer); err != nil {
+		return err
+	}
+	if err := checkTrustedIndex(&c.FileServer, c.Mode != mount.ModeReadOnly); err != nil {
+		return err
+	}
+	if len(c.Mounts) == 0 {
+		// the root is only served without mounts
+		if err := c.checkDataDir(c.Root); err != nil {
+			return err
+		}
+	}
+	if err := c.FileServer.Validate(); err != nil {
+		return err
+	}
+	if err := c.Upload.Validate(); err != nil {
+		return fmt.Errorf("upload: %v", err)
+	}
+	if err := c.Throttle.Validate(); err != nil {
+		return fmt.Errorf("throttle: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, m := range c.Mounts {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("mount %q: %v", m.Path, err)
+		}
+		if err := c.checkSignedOnly(&m.FileServer); err != nil {
+			return fmt.Errorf("mount %q: %v", m.Path, err)
+		}
+		if err := c.checkDataDir(m.Root); err != nil {
+			return fmt.Errorf("mount %q: %v", m.Path, err)
+		}
+		if seen[m.Path] {
+			return fmt.Errorf("mount %q: path is used twice", m.Path)
+		}
+		seen[m.Path] = true
+	}
+	return nil
+}
+
+// checkSignedOnly ensures that signed_only in fsrv protects something:
+// links can only be minted by users identified by a client
+// certificate, so it needs client_ca.
+func (c *Config) checkSignedOnly(fsrv *fileserver.FileServer) error {
+	if fsrv.SignedOnly && (c.TLS == nil || c.TLS.ClientCA == "") {
+		return errors.New("signed_only needs tls.client_ca, or anyone could sign links")
+	}
+	return nil
+}
+
+// checkTrustedIndex ensures that trusted_index in fsrv is only set
+// for roots that are not writable, whose index files can't have
+// been uploaded.
+func checkTrustedIndex(fsrv *fileserver.FileServer, writable bool) error {
+	if fsrv.TrustedIndex && writable {
+		return errors.New("trusted_index needs mode read-only, or uploaded index files could run scripts")
+	}
+	return nil
+}
+
+// validate ensures m is a valid mount.
+func (m *Mount) validate() error {
+	switch {
+	case m.Path == "":
+		return errors.New("no path given")
+	case strings.ContainsAny(m.Path, `/\`) || m.Path == "." || m.Path == "..":
+		return errors.New("path must be a single name")
+	case strings.HasPrefix(m.Path, "_") || m.Path == "s":
+		// those are taken by the server itself
+		return errors.New("path must not start with _ or be s")
+	}
+	if err := mount.CheckMode(m.Mode); err != nil {
+		return err
+	}
+	if m.Mode == mount.ModeDropBox && m.Upload == nil {
+		return errors.New("a drop box needs upload settings")
+	}
+	if err := checkTrustedIndex(&m.FileServer, m.Mode != mount.ModeReadOnly && m.Upload != nil); err != nil {
+		return err
+	}
+	if err := m.FileServer.Validate(); err != nil {
+		return err
+	}
+	if m.Upload != nil {
+		if err := m.Upload.Validate(); err != nil {
+			return fmt.Errorf("upload: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file with the given contents and
+// returns its name.
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	name = filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestPrecedence(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	root := t.TempDir()
+	file := writeConfig(t, "iupload.yaml", `
+root: `+root+`
+mode: read-only
+shutdown_timeout: 10s
+upload:
+  conflict: rename
+`)
+
+	// the file beats the defaults
+	cfg, err := Load([]string{"-config", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Root != root || cfg.Mode != "read-only" || time.Duration(cfg.ShutdownTimeout) != 10*time.Second || cfg.Upload.Conflict != "rename" {
+		t.Errorf("file settings not applied: root %s, mode %s, shutdown_timeout %v, conflict %s",
+			cfg.Root, cfg.Mode, time.Duration(cfg.ShutdownTimeout), cfg.Upload.Conflict)
+	}
+	if len(cfg.Listen) != 1 || cfg.Listen[0] != ":44321" {
+		t.Errorf("listen = %q, want the default", cfg.Listen)
+	}
+
+	// the environment beats the file, and flags beat both
+	t.Setenv("IUPLOAD_MODE", "drop-box")
+	t.Setenv("IUPLOAD_CONFLICT", "reject")
+	t.Setenv("IUPLOAD_SHUTDOWN_TIMEOUT", "20s")
+	cfg, err = Load([]string{"-config", file, "-mode", "read-write", "-shutdown-timeout", "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != "read-write" {
+		t.Errorf("mode = %s, want the flag's read-write", cfg.Mode)
+	}
+	if time.Duration(cfg.ShutdownTimeout) != 5*time.Second {
+		t.Errorf("shutdown_timeout = %v, want the flag's 5s", time.Duration(cfg.ShutdownTimeout))
+	}
+	if cfg.Upload.Conflict != "reject" {
+		t.Errorf("conflict = %s, want the environment's reject", cfg.Upload.Conflict)
+	}
+
+	// the config file can come from the environment too
+	t.Setenv("IUPLOAD_CONFIG", file)
+	os.Unsetenv("IUPLOAD_MODE") // restored by t.Setenv above
+	if cfg, err = Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Root != root || cfg.Mode != "read-only" {
+		t.Errorf("IUPLOAD_CONFIG not read: root %s, mode %s", cfg.Root, cfg.Mode)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	root := t.TempDir()
+	tests := []struct {
+		name string
+		args []string
+		file string
+		want string
+	}{
+		{"unknown key", nil, "root: " + root + "\nrooot: x\n", "rooot"},
+		{"bad mode", []string{"-mode", "write-only"}, "root: " + root + "\n", "write-only"},
+		{"bad flag value", []string{"-shutdown-timeout", "soon"}, "root: " + root + "\n", "shutdown-timeout"},
+		{"stray argument", []string{"extra"}, "root: " + root + "\n", "unexpected arguments"},
+	}
+	for _, tt := range tests {
+		file := writeConfig(t, "iupload.yaml", tt.file)
+		_, err := Load(append([]string{"-config", file}, tt.args...))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want one mentioning %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	root := t.TempDir()
+
+	cfg, err := Load([]string{"-root", root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(config, "iupload"); cfg.DataDir != want {
+		t.Errorf("data_dir = %s, want %s", cfg.DataDir, want)
+	}
+
+	for _, dataDir := range []string{root, filepath.Join(root, ".iupload"), filepath.Join(root, "a", "b")} {
+		if _, err := Load([]string{"-root", root, "-data-dir", dataDir}); err == nil {
+			t.Errorf("data_dir %s inside the root was accepted", dataDir)
+		}
+	}
+
+	// a link to the root is the root all the same
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(root, link); err == nil {
+		if _, err := Load([]string{"-root", root, "-data-dir", filepath.Join(link, "data")}); err == nil {
+			t.Error("data_dir inside the root through a symbolic link was accepted")
+		}
+	}
+
+	mounted := t.TempDir()
+	file := writeConfig(t, "iupload.yaml", `
+mounts:
+  - path: builds
+    root: `+mounted+`
+`)
+	if _, err := Load([]string{"-config", file, "-data-dir", filepath.Join(mounted, "data")}); err == nil {
+		t.Error("data_dir inside a mount was accepted")
+	}
+	// with mounts, the root itself is not served
+	if _, err := Load([]string{"-config", file, "-root", root, "-data-dir", filepath.Join(root, "data")}); err != nil {
+		t.Errorf("data_dir inside the unserved root: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"iupload/fileserver"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// setting is a setting that can be made with a command-line flag
+// or an environment variable.
+type setting struct {
+	name   string
+	env    string
+	usage  string
+	isBool bool
+	apply  func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{
+		name:  "listen",
+		env:   "IUPLOAD_LISTEN",
+		usage: "comma-separated `addresses` to listen on: host:port, unix:path or systemd:[name]",
+		apply: func(c *Config, value string) error {
+			c.Listen = strings.Split(value, ",")
+			return nil
+		},
+	},
+	{
+		name:  "socket-mode",
+		env:   "IUPLOAD_SOCKET_MODE",
+		usage: "octal `permissions` of Unix domain sockets, such as 0660",
+		apply: func(c *Config, value string) error {
+			return c.SocketMode.parse(value)
+		},
+	},
+	{
+		name:  "root",
+		env:   "IUPLOAD_ROOT",
+		usage: "`directory` to serve files from and upload them to",
+		apply: func(c *Config, value string) error {
+			c.Root = value
+			return nil
+		},
+	},
+	{
+		name:  "base-path",
+		env:   "IUPLOAD_BASE_PATH",
+		usage: "`path` the server is reached under through a reverse proxy, such as /files",
+		apply: func(c *Config, value string) error {
+			c.BasePath = value
+			return nil
+		},
+	},
+	{
+		name:  "trusted-proxies",
+		env:   "IUPLOAD_TRUSTED_PROXIES",
+		usage: "comma-separated `addresses` and networks of reverse proxies whose X-Forwarded-Prefix and X-Forwarded-Proto headers are trusted, or unix",
+		apply: func(c *Config, value string) error {
+			c.TrustedProxies = strings.Split(value, ",")
+			return nil
+		},
+	},
+	{
+		name:  "data-dir",
+		env:   "IUPLOAD_DATA_DIR",
+		usage: "`directory` to keep the server's own state in",
+		apply: func(c *Config, value string) error {
+			c.DataDir = value
+			return nil
+		},
+	},
+	{
+		name:   "debug",
+		env:    "IUPLOAD_DEBUG",
+		usage:  "run the router in debug mode",
+		isBool: true,
+		apply: func(c *Config, value string) (err error) {
+			c.Debug, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		name:  "shutdown-timeout",
+		env:   "IUPLOAD_SHUTDOWN_TIMEOUT",
+		usage: "how long to let transfers finish when stopping, as a `duration` such as 30s",
+		apply: func(c *Config, value string) error {
+			d, err := time.ParseDuration(value)
+			c.ShutdownTimeout = Duration(d)
+			return err
+		},
+	},
+	{
+		name:  "mode",
+		env:   "IUPLOAD_MODE",
+		usage: "what clients may do: read-write, read-only or drop-box",
+		apply: func(c *Config, value string) error {
+			c.Mode = value
+			return nil
+		},
+	},
+	{
+		name:  "tls-cert",
+		env:   "IUPLOAD_TLS_CERT",
+		usage: "PEM `file` with the TLS certificate chain",
+		apply: func(c *Config, value string) error {
+			c.tls().Cert = value
+			return nil
+		},
+	},
+	{
+		name:  "tls-key",
+		env:   "IUPLOAD_TLS_KEY",
+		usage: "PEM `file` with the TLS private key",
+		apply: func(c *Config, value string) error {
+			c.tls().Key = value
+			return nil
+		},
+	},
+	{
+		name:   "tls-self-signed",
+		env:    "IUPLOAD_TLS_SELF_SIGNED",
+		usage:  "serve HTTPS with a self-signed certificate kept in the data directory",
+		isBool: true,
+		apply: func(c *Config, value string) (err error) {
+			c.tls().SelfSigned, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		name:  "tls-client-ca",
+		env:   "IUPLOAD_TLS_CLIENT_CA",
+		usage: "PEM `file` with the CA certificates that client certificates must be signed by",
+		apply: func(c *Config, value string) error {
+			c.tls().ClientCA = value
+			return nil
+		},
+	},
+	{
+		name:  "tls-user-field",
+		env:   "IUPLOAD_TLS_USER_FIELD",
+		usage: "`field` of client certificates naming the user: cn, email, dns or uri",
+		apply: func(c *Config, value string) error {
+			c.tls().UserField = value
+			return nil
+		},
+	},
+	{
+		name:   "browse",
+		env:    "IUPLOAD_BROWSE",
+		usage:  "list the contents of directories",
+		isBool: true,
+		apply: func(c *Config, value string) error {
+			browse, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			if !browse {
+				c.Browse = nil
+			} else if c.Browse == nil {
+				c.Browse = &fileserver.Browse{}
+			}
+			return nil
+		},
+	},
+	{
+		name:  "template",
+		env:   "IUPLOAD_TEMPLATE",
+		usage: "`file` with the template for directory listings",
+		apply: func(c *Config, value string) error {
+			if c.Browse == nil {
+				c.Browse = &fileserver.Browse{}
+			}
+			c.Browse.TemplateFile = value
+			return nil
+		},
+	},
+	{
+		name:   "signed-only",
+		env:    "IUPLOAD_SIGNED_ONLY",
+		usage:  "refuse downloads without a signed link",
+		isBool: true,
+		apply: func(c *Config, value string) (err error) {
+			c.SignedOnly, err = strconv.ParseBool(value)
+			return err
+		},
+	},
+	{
+		name:  "conflict",
+		env:   "IUPLOAD_CONFLICT",
+		usage: "`policy` for uploaded files that exist: overwrite, reject, rename or keep-both",
+		apply: func(c *Config, value string) error {
+			c.Upload.Conflict = value
+			return nil
+		},
+	},
+	{
+		name:  "max-file-size",
+		env:   "IUPLOAD_MAX_FILE_SIZE",
+		usage: "maximum `size` of an uploaded file, such as 10GB; 0 for no limit",
+		apply: func(c *Config, value string) (err error) {
+			c.Upload.MaxFileSize, err = parseSize(value)
+			return err
+		},
+	},
+	{
+		name:  "max-request-size",
+		env:   "IUPLOAD_MAX_REQUEST_SIZE",
+		usage: "maximum `size` of an upload request; 0 for no limit",
+		apply: func(c *Config, value string) (err error) {
+			c.Upload.MaxRequestSize, err = parseSize(value)
+			return err
+		},
+	},
+	{
+		name:  "min-free-space",
+		env:   "IUPLOAD_MIN_FREE_SPACE",
+		usage: "disk space, as a `size`, that uploads must leave free; 0 to disable",
+		apply: func(c *Config, value string) (err error) {
+			c.Upload.MinFreeSpace, err = parseSize(value)
+			return err
+		},
+	},
+}
+
+// tls returns the TLS settings of c, adding them if there are none.
+func (c *Config) tls() *TLS {
+	if c.TLS == nil {
+		c.TLS = &TLS{}
+	}
+	return c.TLS
+}
+
+// parseSize parses a number of bytes, which may be given with a unit
+// like "512MB" or "2GiB".
+func parseSize(value string) (int64, error) {
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxInt64 {
+		return 0, strconv.ErrRange
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,123 @@
+package digest
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSyncLimit is the size up to which digests of files
+	// not in the cache yet are computed while the client waits.
+	defaultSyncLimit = 256 << 20
+
+	// maxCacheEntries bounds the memory used by a Cache.
+	maxCacheEntries = 10000
+)
+
+// Cache remembers the digests of files on disk. Entries are keyed
+// by file name and invalidated when the size or modification time
+// of the file changes.
+type Cache struct {
+	// Digests of files larger than this many bytes are computed in
+	// the background instead of while the caller waits, so the first
+	// request for a large file goes without them. Default: 256 MiB
+	SyncLimit int64
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	pending map[string]struct{}
+}
+
+type cacheEntry struct {
+	size    int64
+	modTime time.Time
+	sums    Sums
+}
+
+// Put records sums as the digests of the file called name, for
+// example right after it has been uploaded and hashed on the way.
+func (c *Cache) Put(name string, sums Sums) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(name, cacheEntry{size: info.Size(), modTime: info.ModTime(), sums: sums})
+}
+
+// File returns the digests of the file called name. If they are not
+// known yet and the file is larger than SyncLimit, it returns nil
+// and computes them in the background.
+func (c *Cache) File(name string) (Sums, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		c.mu.Unlock()
+		return entry.sums, nil
+	}
+	limit := c.SyncLimit
+	if limit <= 0 {
+		limit = defaultSyncLimit
+	}
+	if info.Size() > limit {
+		if _, busy := c.pending[name]; !busy {
+			if c.pending == nil {
+				c.pending = make(map[string]struct{})
+			}
+			c.pending[name] = struct{}{}
+			go c.compute(name)
+		}
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.mu.Unlock()
+	return c.compute(name)
+}
+
+// compute hashes the file called name and caches the result.
+func (c *Cache) compute(name string) (Sums, error) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, name)
+		c.mu.Unlock()
+	}()
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sums, err := Sum(f)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(name, cacheEntry{size: info.Size(), modTime: info.ModTime(), sums: sums})
+	return sums, nil
+}
+
+func (c *Cache) put(name string, entry cacheEntry) {
+	if c.entries == nil {
+		c.entries = make(map[string]cacheEntry)
+	}
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= maxCacheEntries {
+		// evict an arbitrary entry
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[name] = entry
+}
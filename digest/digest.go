@@ -0,0 +1,204 @@
+// Package digest computes, parses and verifies the file digests
+// exchanged in Content-Digest, Repr-Digest (RFC 9530) and the older
+// Digest (RFC 3230) header fields.
+package digest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Supported digest algorithms, named as in the HTTP Digest
+// Algorithm Values registry.
+const (
+	SHA256 = "sha-256"
+	MD5    = "md5"
+)
+
+// Sums maps algorithm names to digest values.
+type Sums map[string][]byte
+
+// Hash computes the digests of everything written to it with
+// all supported algorithms at once.
+type Hash struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+	w      io.Writer
+}
+
+// New returns a new Hash.
+func New() *Hash {
+	h := &Hash{sha256: sha256.New(), md5: md5.New()}
+	h.w = io.MultiWriter(h.sha256, h.md5)
+	return h
+}
+
+func (h *Hash) Write(p []byte) (int, error) { return h.w.Write(p) }
+
+// Sums returns the digests of the data written so far.
+func (h *Hash) Sums() Sums {
+	return Sums{
+		SHA256: h.sha256.Sum(nil),
+		MD5:    h.md5.Sum(nil),
+	}
+}
+
+// MarshalBinary returns the state of h, so that hashing can go on
+// later from where it stopped.
+func (h *Hash) MarshalBinary() ([]byte, error) {
+	var state []byte
+	for _, hh := range []hash.Hash{h.sha256, h.md5} {
+		b, err := hh.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		state = binary.AppendUvarint(state, uint64(len(b)))
+		state = append(state, b...)
+	}
+	return state, nil
+}
+
+// UnmarshalBinary restores a state of h returned by MarshalBinary.
+func (h *Hash) UnmarshalBinary(state []byte) error {
+	for _, hh := range []hash.Hash{h.sha256, h.md5} {
+		n, size := binary.Uvarint(state)
+		if size <= 0 || uint64(len(state)-size) < n {
+			return errors.New("truncated hash state")
+		}
+		state = state[size:]
+		if err := hh.(encoding.BinaryUnmarshaler).UnmarshalBinary(state[:n]); err != nil {
+			return err
+		}
+		state = state[n:]
+	}
+	return nil
+}
+
+// Sum returns the digests of everything read from r.
+func Sum(r io.Reader) (Sums, error) {
+	h := New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sums(), nil
+}
+
+// Algorithm returns the canonical name of the algorithm called
+// name, which may also be spelled like "SHA256" or "sha256", or
+// "" if it is not supported.
+func Algorithm(name string) string {
+	switch strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "-", "") {
+	case "sha256":
+		return SHA256
+	case "md5":
+		return MD5
+	}
+	return ""
+}
+
+// ParseHeader parses a Content-Digest or Repr-Digest field value
+// such as "sha-256=:base64:", as well as the value of the older
+// Digest field, where the digest is not enclosed in colons.
+// Entries for unsupported algorithms are skipped, but a value naming
+// none that is supported is an error, since nothing could be
+// verified.
+func ParseHeader(value string) (Sums, error) {
+	sums := make(Sums)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, encoded, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed digest %q", item)
+		}
+		alg := Algorithm(name)
+		if alg == "" {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.Trim(encoded, ":"))
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s digest: %v", alg, err)
+		}
+		sums[alg] = sum
+	}
+	if len(sums) == 0 && strings.TrimSpace(value) != "" {
+		return nil, fmt.Errorf("no supported algorithm in digest %q; use %s or %s", value, SHA256, MD5)
+	}
+	return sums, nil
+}
+
+// ParseValue decodes a single digest given either in hex, as
+// printed by tools like sha256sum, or in base64.
+func ParseValue(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if sum, err := hex.DecodeString(value); err == nil {
+		return sum, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("digest is neither hex nor base64")
+	}
+	return sum, nil
+}
+
+// Verify compares s, the computed digests, against expected. Only
+// algorithms present in both are compared, so an empty expected
+// always passes.
+func (s Sums) Verify(expected Sums) error {
+	for alg, want := range expected {
+		got, ok := s[alg]
+		if ok && !bytes.Equal(got, want) {
+			return fmt.Errorf("%s digest mismatch: expected %x, got %x", alg, want, got)
+		}
+	}
+	return nil
+}
+
+// Header formats s as a Content-Digest or Repr-Digest field value.
+func (s Sums) Header() string {
+	return s.format(func(alg string, sum []byte) string {
+		return alg + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+	})
+}
+
+// LegacyHeader formats s as a Digest field value.
+func (s Sums) LegacyHeader() string {
+	return s.format(func(alg string, sum []byte) string {
+		return alg + "=" + base64.StdEncoding.EncodeToString(sum)
+	})
+}
+
+func (s Sums) format(item func(alg string, sum []byte) string) string {
+	algs := make([]string, 0, len(s))
+	for alg := range s {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	items := make([]string, len(algs))
+	for i, alg := range algs {
+		items[i] = item(alg, s[alg])
+	}
+	return strings.Join(items, ", ")
+}
+
+// Hex returns s with the digests encoded in hex, for JSON responses.
+func (s Sums) Hex() map[string]string {
+	m := make(map[string]string, len(s))
+	for alg, sum := range s {
+		m[alg] = hex.EncodeToString(sum)
+	}
+	return m
+}
@@ -0,0 +1,152 @@
+package fileserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+type basePathKey struct{}
+
+type schemeKey struct{}
+
+// Proxies are the reverse proxies whose X-Forwarded-Prefix and
+// X-Forwarded-Proto headers are trusted. Anyone else could send them
+// to have links and redirects point elsewhere.
+type Proxies struct {
+	prefixes []netip.Prefix
+	unix     bool
+}
+
+// ParseProxies parses addresses such as "127.0.0.1", networks such as
+// "10.0.0.0/8", and "unix" for clients connecting over Unix domain
+// sockets.
+func ParseProxies(list []string) (Proxies, error) {
+	var p Proxies
+	for _, s := range list {
+		switch {
+		case s == "unix":
+			p.unix = true
+		case strings.Contains(s, "/"):
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return Proxies{}, fmt.Errorf("invalid proxy network %q", s)
+			}
+			p.prefixes = append(p.prefixes, prefix.Masked())
+		default:
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return Proxies{}, fmt.Errorf("invalid proxy address %q", s)
+			}
+			p.prefixes = append(p.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return p, nil
+}
+
+// Trust reports whether r comes from one of p.
+func (p Proxies) Trust(r *http.Request) bool {
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		return p.unix
+	}
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripBasePath serves requests for paths below base with next, as
+// if they had been made for the top level. Requests for other paths
+// are answered with 404 Not Found. The path that clients reach the
+// server under, made of the X-Forwarded-Prefix header that reverse
+// proxies send after stripping a prefix of their own and of base, is
+// recorded for BasePath, and the scheme in the X-Forwarded-Proto
+// header for AbsoluteURL. Both headers are ignored unless the request
+// comes from one of proxies.
+func StripBasePath(base string, proxies Proxies, next http.Handler) http.Handler {
+	base = cleanBasePath(base)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, scheme := base, ""
+		if proxies.Trust(r) {
+			prefix = cleanBasePath(r.Header.Get("X-Forwarded-Prefix")) + base
+			scheme = forwardedScheme(r.Header.Get("X-Forwarded-Proto"))
+		}
+		if base != "" {
+			rest, ok := strings.CutPrefix(r.URL.Path, base)
+			if !ok || (rest != "" && rest[0] != '/') {
+				http.NotFound(w, r)
+				return
+			}
+			if rest == "" {
+				redirect(w, r, prefix+"/")
+				return
+			}
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = rest, ""
+		}
+		ctx := r.Context()
+		if prefix != "" {
+			ctx = context.WithValue(ctx, basePathKey{}, prefix)
+		}
+		if scheme != "" {
+			ctx = context.WithValue(ctx, schemeKey{}, scheme)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// forwardedScheme returns the scheme that the first proxy was reached
+// with, from the value of an X-Forwarded-Proto header, or "" if it is
+// not one served here.
+func forwardedScheme(proto string) string {
+	proto, _, _ = strings.Cut(proto, ",")
+	proto = strings.ToLower(strings.TrimSpace(proto))
+	if proto == "http" || proto == "https" {
+		return proto
+	}
+	return ""
+}
+
+// BasePath returns the path that the client reaches the server under,
+// such as "/files", which links and redirects must start with. It is
+// empty for servers reached at the top level.
+func BasePath(r *http.Request) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	return base
+}
+
+// AbsoluteURL returns the URL of the path p on the server, as the
+// client of r reaches it.
+func AbsoluteURL(r *http.Request, p string) string {
+	scheme, _ := r.Context().Value(schemeKey{}).(string)
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + r.Host + BasePath(r) + p
+}
+
+// cleanBasePath returns p as a base path: starting with a slash and
+// not ending in one, or empty for the top level.
+func cleanBasePath(p string) string {
+	if p == "" {
+		return ""
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return ""
+	}
+	return p
+}
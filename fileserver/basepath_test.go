@@ -0,0 +1,52 @@
+package fileserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.0/8", "192.0.2.7", "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	h := StripBasePath("/files", proxies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = AbsoluteURL(r, r.URL.Path)
+	}))
+
+	tests := []struct {
+		remote string
+		unix   bool
+		want   string
+	}{
+		{"10.1.2.3:4000", false, "https://example.com/proxy/files/a.txt"},
+		{"192.0.2.7:4000", false, "https://example.com/proxy/files/a.txt"},
+		{"[::ffff:10.1.2.3]:4000", false, "https://example.com/proxy/files/a.txt"},
+		{"192.0.2.8:4000", false, "http://example.com/files/a.txt"},
+		{"@", true, "https://example.com/proxy/files/a.txt"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/files/a.txt", nil)
+		r.RemoteAddr = tt.remote
+		if tt.unix {
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/iupload.sock", Net: "unix"}))
+		}
+		r.Header.Set("X-Forwarded-Prefix", "/proxy")
+		r.Header.Set("X-Forwarded-Proto", "https, http")
+		got = ""
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tt.want {
+			t.Errorf("from %s: URL %s, want %s", tt.remote, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "localhost", ""} {
+		if _, err := ParseProxies([]string{bad}); err == nil {
+			t.Errorf("proxy %q was accepted", bad)
+		}
+	}
+}
@@ -3,14 +3,19 @@ package fileserver
 import (
 	"bytes"
 	_ "embed"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
+	"iupload/auth"
+	"iupload/digest"
 	"iupload/templates"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
@@ -34,6 +39,148 @@ type FileServer struct {
 	Root       string   `json:"root,omitempty"`
 	IndexNames []string `json:"index_names,omitempty"`
 	Browse     *Browse  `json:"browse,omitempty"`
+
+	// A list of file names or glob patterns to hide from listings
+	// and to refuse to serve. Patterns without a path separator
+	// are matched against the base name of each file.
+	Hide []string `json:"hide,omitempty"`
+
+	// Encodings of precompressed files to look for next to requested
+	// files, in order of preference: "br", "zstd" and "gzip" for files
+	// ending in .br, .zst and .gz. A precompressed file is served in
+	// place of the requested one if the client accepts its encoding.
+	Precompressed []string `json:"precompressed,omitempty"`
+
+	// Compress files and directory listings of compressible types on
+	// the fly with zstd or gzip, for clients accepting either.
+	Compress bool `json:"compress,omitempty"`
+
+	// Responses shorter than this many bytes are not compressed on
+	// the fly. Default: 512
+	MinCompressLength int64 `json:"min_compress_length,omitempty"`
+
+	// The path prefix the file server is mounted under, such as that
+	// of a share or a mount. It is stripped from request paths before
+	// they are mapped to files.
+	Prefix string `json:"-"`
+
+	// If set, files are read from FS rather than from Root.
+	FS fs.FS `json:"-"`
+
+	// Whether directory listings offer forms to upload files and to
+	// download a selection of files, which go to /_upload and
+	// /_download with the directory path as shown to the client.
+	UploadForm    bool `json:"-"`
+	SelectionForm bool `json:"-"`
+
+	// Serve directories as a drop box: listings show nothing but the
+	// upload form, and files cannot be fetched.
+	DropBox bool `json:"-"`
+
+	// The users, identified by their client certificates, that the
+	// upload form is offered to. Empty offers it to everyone.
+	UploadUsers []string `json:"-"`
+
+	// The users, identified by their client certificates, who may
+	// browse and download the files. Empty lets everyone in.
+	Users []string `json:"users,omitempty"`
+
+	// Extensions of files, such as ".pdf", that downloads show in the
+	// browser unless the "inline" parameter says otherwise.
+	InlineExtensions []string `json:"inline_extensions,omitempty"`
+
+	// The secret that download links are signed with. Without it,
+	// no signed links can be made.
+	Secret []byte `json:"-"`
+
+	// Let index files run scripts, which other pages, and index
+	// files by default, are kept from with a sandbox. Only for roots
+	// that nobody can upload to, since an uploaded page could use the
+	// API on behalf of whoever views it.
+	TrustedIndex bool `json:"trusted_index,omitempty"`
+
+	// Refuse downloads through links without a valid signature.
+	SignedOnly bool `json:"signed_only,omitempty"`
+
+	// If set, downloads announce the digests of files, which are
+	// remembered here.
+	Digests *digest.Cache `json:"-"`
+}
+
+// fileSystem returns the file system that files are read from.
+func (fsrv *FileServer) fileSystem() fs.FS {
+	if fsrv.FS != nil {
+		return fsrv.FS
+	}
+	return os.DirFS(fsrv.Root)
+}
+
+// Validate ensures fsrv has a valid configuration.
+func (fsrv *FileServer) Validate() error {
+	if fsrv.Root == "" {
+		return fmt.Errorf("no root directory given")
+	}
+	if info, err := os.Stat(fsrv.Root); err == nil && !info.IsDir() {
+		return fmt.Errorf("root %s is not a directory", fsrv.Root)
+	}
+	for _, pattern := range fsrv.Hide {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("hide pattern %q: %v", pattern, err)
+		}
+	}
+	for _, coding := range fsrv.Precompressed {
+		if _, ok := sidecarExts[coding]; !ok {
+			return fmt.Errorf("unknown precompressed encoding %q", coding)
+		}
+	}
+	if fsrv.MinCompressLength < 0 {
+		return fmt.Errorf("min_compress_length must not be negative")
+	}
+	if fsrv.Browse != nil {
+		return fsrv.Browse.Validate()
+	}
+	return nil
+}
+
+// Validate ensures b has a valid configuration.
+func (b *Browse) Validate() error {
+	if b.TemplateFile != "" {
+		if _, err := os.Stat(b.TemplateFile); err != nil {
+			return fmt.Errorf("browse template: %v", err)
+		}
+	}
+	if b.FileLimit < 0 {
+		return fmt.Errorf("file_limit must not be negative")
+	}
+	for _, option := range b.SortOptions {
+		switch option {
+		case sortByName, sortByNameDirFirst, sortBySize, sortByTime, sortOrderAsc, sortOrderDesc:
+		default:
+			return fmt.Errorf("unknown sort option %q", option)
+		}
+	}
+	return nil
+}
+
+// IsHidden reports whether the file at reqPath, relative to the
+// root, matches any of the configured Hide patterns.
+func (fsrv *FileServer) IsHidden(reqPath string) bool {
+	reqPath = path.Clean("/" + reqPath)
+	for _, pattern := range fsrv.Hide {
+		if !strings.Contains(pattern, "/") {
+			for _, elem := range strings.Split(reqPath, "/") {
+				if ok, _ := path.Match(pattern, elem); ok {
+					return true
+				}
+			}
+			continue
+		}
+		pattern = path.Clean("/" + pattern)
+		if ok, _ := path.Match(pattern, reqPath); ok || strings.HasPrefix(reqPath, pattern+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 func SanitizedPathJoin(root, reqPath string) string {
@@ -59,7 +206,11 @@ func SanitizedPathJoin(root, reqPath string) string {
 
 	return path
 }
+
+// redirect redirects the client to toPath on the server, below its
+// base path.
 func redirect(w http.ResponseWriter, r *http.Request, toPath string) error {
+	toPath = BasePath(r) + toPath
 	for strings.HasPrefix(toPath, "//") {
 		// prevent path-based open redirects
 		toPath = strings.TrimPrefix(toPath, "/")
@@ -90,22 +241,34 @@ func (fsrv *FileServer) serveBrowse(fileSystem fs.FS, root, dirPath string, w ht
 	origReq := r
 	if r.URL.Path == "" || path.Base(origReq.URL.Path) == path.Base(r.URL.Path) {
 		if !strings.HasSuffix(origReq.URL.Path, "/") {
-			return redirect(w, r, origReq.URL.Path+"/")
+			return redirect(w, r, fsrv.Prefix+origReq.URL.Path+"/")
 		}
 	}
 
-	dir, err := fileSystem.Open(dirPath)
-	if err != nil {
-		return err
-	}
-	defer dir.Close()
-
 	// TODO: not entirely sure if path.Clean() is necessary here but seems like a safe plan (i.e. /%2e%2e%2f) - someone could verify this
-	listing, err := fsrv.loadDirectoryContents(fileSystem, dir.(fs.ReadDirFile), root, path.Clean(r.URL.EscapedPath()))
-	if err != nil {
-		return err
+	urlPath := path.Clean(r.URL.EscapedPath())
+	var listing *browseTemplateContext
+	if fsrv.DropBox {
+		// nothing that others dropped off is shown
+		listing = fsrv.directoryListing(fileSystem, nil, false, root, urlPath)
+	} else {
+		dir, err := fileSystem.Open(dirPath)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+
+		if listing, err = fsrv.loadDirectoryContents(fileSystem, dir.(fs.ReadDirFile), root, urlPath); err != nil {
+			return err
+		}
 	}
 
+	listing.Path = (&url.URL{Path: fsrv.Prefix}).EscapedPath() + listing.Path
+	listing.UploadForm, listing.SelectionForm = fsrv.UploadForm, fsrv.SelectionForm && !fsrv.DropBox
+	listing.DropBox = fsrv.DropBox
+	listing.Base = BasePath(r)
+	listing.User = auth.User(r)
+	listing.UploadForm = listing.UploadForm && auth.Allowed(listing.User, fsrv.UploadUsers)
 	fsrv.browseApplyQueryParams(w, r, listing)
 
 	buf := bufPool.Get().(*bytes.Buffer)
@@ -120,13 +283,38 @@ func (fsrv *FileServer) serveBrowse(fileSystem fs.FS, root, dirPath string, w ht
 		browseTemplateContext: listing,
 	}
 
-	tpl, err := fsrv.makeBrowseTemplate(tplCtx)
-	if err != nil {
-		return fmt.Errorf("parsing browse template: %v", err)
+	acceptHeader := strings.ToLower(strings.Join(r.Header["Accept"], ","))
+	if !listing.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", listing.lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	switch {
+	case strings.Contains(acceptHeader, "application/json"):
+		if err := json.NewEncoder(buf).Encode(listing.Items); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	default:
+		tpl, err := fsrv.makeBrowseTemplate(tplCtx)
+		if err != nil {
+			return fmt.Errorf("parsing browse template: %v", err)
+		}
+		if err := tpl.Execute(buf, tplCtx); err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+
+	if cw := fsrv.compressResponse(w, r, w.Header().Get("Content-Type"), int64(buf.Len())); cw != nil {
+		defer cw.Close()
+		w = cw
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
 	}
 	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	return tpl.Execute(w, tplCtx)
+	_, err := buf.WriteTo(w)
+	return err
 }
 
 func (fsrv *FileServer) loadDirectoryContents(fileSystem fs.FS, dir fs.ReadDirFile, root, urlPath string) (*browseTemplateContext, error) {
@@ -16,10 +16,10 @@ import (
 
 func (fsrv *FileServer) directoryListing(fileSystem fs.FS, entries []fs.DirEntry, canGoUp bool, root, urlPath string) *browseTemplateContext {
 
-	name, _ := url.PathUnescape(urlPath)
+	dirPath, _ := url.PathUnescape(urlPath)
 
 	tplCtx := &browseTemplateContext{
-		Name:    path.Base(name),
+		Name:    path.Base(dirPath),
 		Path:    urlPath,
 		CanGoUp: canGoUp,
 	}
@@ -27,6 +27,10 @@ func (fsrv *FileServer) directoryListing(fileSystem fs.FS, entries []fs.DirEntry
 	for _, entry := range entries {
 		name := entry.Name()
 
+		if fsrv.IsHidden(path.Join(dirPath, name)) {
+			continue
+		}
+
 		info, err := entry.Info()
 		if err != nil {
 			continue
@@ -140,6 +144,24 @@ type browseTemplateContext struct {
 	// Display format (list or grid)
 	Layout string `json:"layout,omitempty"`
 
+	// Whether to offer forms to upload files into the directory and
+	// to download a selection of its files.
+	UploadForm    bool `json:"-"`
+	SelectionForm bool `json:"-"`
+
+	// The path that the client reaches the server under, such as
+	// "/files", which Path and links to /_upload and /_download are
+	// relative to. Empty at the top level.
+	Base string `json:"-"`
+
+	// Whether the directory is a drop box, whose contents are not
+	// listed.
+	DropBox bool `json:"-"`
+
+	// The user viewing the listing, as identified by their client
+	// certificate, or empty.
+	User string `json:"-"`
+
 	// The most recent file modification date in the listing.
 	// Used for HTTP header purposes.
 	lastModified time.Time
@@ -174,6 +196,16 @@ func (l browseTemplateContext) Breadcrumbs() []crumb {
 	return result
 }
 
+// Dir returns the unescaped path of the directory, for
+// use in form fields.
+func (l browseTemplateContext) Dir() string {
+	dir, err := url.PathUnescape(l.Path)
+	if err != nil {
+		return l.Path
+	}
+	return dir
+}
+
 func (l *browseTemplateContext) applySortAndLimit(sortParam, orderParam, limitParam string, offsetParam string) {
 	l.Sort = sortParam
 	l.Order = orderParam
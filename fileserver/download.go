@@ -0,0 +1,257 @@
+package fileserver
+
+import (
+	"fmt"
+	"io/fs"
+	"iupload/archive"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ServeDownload serves the file named by the "file" parameter,
+// relative to the directory in the "dir" parameter or the root, as
+// an attachment. Parameters are taken from the query string or a
+// form-encoded POST body.
+//
+// Directories, and selections of several files given by repeating
+// the "file" parameter, are streamed as an archive without being
+// staged on disk. The "format" parameter picks the archive format
+// (zip, tar, tar.gz, tar.xz or tar.zst; zip by default) and, for
+// selections, "name" the name of the archive.
+//
+// With the "inline" parameter set, or for files with one of the
+// InlineExtensions, files are shown in the browser instead, with
+// their real content type. Types that could run scripts, like HTML
+// and SVG, are always downloaded.
+//
+// Links minted by ServeSign carry an expiry time and a signature,
+// which are checked here: tampered links are refused with 403
+// Forbidden and expired ones with 410 Gone. A valid link stands in
+// for the client certificate of one of Users, so that it can be
+// handed on.
+func (fsrv *FileServer) ServeDownload(w http.ResponseWriter, r *http.Request) error {
+	if fsrv.DropBox {
+		return Error(http.StatusForbidden, ErrDropBox)
+	}
+	if err := r.ParseForm(); err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	dir := r.Form.Get("dir")
+	names := r.Form["file"]
+	if len(names) == 0 {
+		return Error(http.StatusBadRequest, fmt.Errorf("no file given"))
+	}
+	for i, name := range names {
+		var err error
+		if names[i], err = fsrv.downloadName(dir, name); err != nil {
+			return err
+		}
+	}
+	signed, err := fsrv.checkSignature(r, names)
+	if err != nil {
+		return err
+	}
+	if !signed {
+		if err := fsrv.Authorize(r); err != nil {
+			return err
+		}
+	}
+	format := r.Form.Get("format")
+	if format == "" {
+		format = archive.Zip
+	}
+
+	if len(names) > 1 {
+		base := strings.ReplaceAll(r.Form.Get("name"), "\\", "/")
+		if strings.Contains(base, "..") {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid archive name %q", base))
+		}
+		if base == "" || base == "/" {
+			base = path.Clean(dir)
+		}
+		base = fsrv.archiveBase(path.Base("/" + base))
+		// once the archive is under way, errors can't be reported
+		fileSystem := fsrv.fileSystem()
+		items := make([]archiveItem, len(names))
+		taken := make(map[string]bool)
+		for i, name := range names {
+			src := name
+			if src == "" {
+				src = "."
+			}
+			if _, err := fs.Stat(fileSystem, src); err != nil || !fsrv.insideRoot(src) {
+				return Error(http.StatusNotFound, fmt.Errorf("%s not found", name))
+			}
+			items[i] = archiveItem{src: name, dst: path.Join(base, uniqueName(taken, path.Base(name)))}
+		}
+		return fsrv.serveArchive(w, base+"."+format, format, items)
+	}
+
+	localPath := SanitizedPathJoin(fsrv.Root, names[0])
+	info, err := os.Stat(localPath)
+	if err != nil || !fsrv.insideRoot(names[0]) {
+		return Error(http.StatusNotFound, fmt.Errorf("file not found"))
+	}
+
+	if info.IsDir() {
+		base := fsrv.archiveBase(path.Base("/" + names[0]))
+		return fsrv.serveArchive(w, base+"."+format, format, []archiveItem{{src: names[0], dst: base}})
+	}
+
+	ctype := ""
+	if fsrv.inlineRequested(r, info.Name()) {
+		if ctype, err = inlineType(localPath); err != nil {
+			return Error(http.StatusInternalServerError, err)
+		}
+	}
+	if ctype != "" {
+		setDisposition(w, "inline", info.Name())
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	} else {
+		setDisposition(w, "attachment", info.Name())
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// announce the digests so that clients can verify the download
+	if fsrv.Digests != nil {
+		if sums, err := fsrv.Digests.File(localPath); err == nil && sums != nil {
+			w.Header().Set("Repr-Digest", sums.Header())
+			w.Header().Set("Digest", sums.LegacyHeader())
+		}
+	}
+	http.ServeFile(w, r, localPath)
+	return nil
+}
+
+// archiveItem is a file or directory to put into an archive.
+type archiveItem struct {
+	src string // relative to the root
+	dst string // within the archive
+}
+
+// serveArchive streams the given items as an archive called filename
+// in the given format. Like the browse listing, it leaves out hidden
+// files and follows symbolic links to files, but it does not descend
+// into symbolic links to directories, which could form loops, and it
+// skips links that lead out of the root.
+func (fsrv *FileServer) serveArchive(w http.ResponseWriter, filename, format string, items []archiveItem) error {
+	aw, err := archive.NewWriter(w, format)
+	if err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	setDisposition(w, "attachment", filename)
+	w.Header().Set("Content-Type", archive.ContentType(format))
+
+	fileSystem := fsrv.fileSystem()
+	for _, item := range items {
+		if item.src == "" {
+			item.src = "."
+		}
+		err = fs.WalkDir(fileSystem, item.src, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if fsrv.IsHidden(name) {
+				if entry.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			sub := name
+			if item.src != "." {
+				sub = strings.TrimPrefix(name, item.src)
+			}
+			return fsrv.addToArchive(aw, fileSystem, name, path.Join(item.dst, sub), entry)
+		})
+		if err != nil {
+			// the response has started, so all we can do is cut it short
+			log.Printf("streaming archive of %s: %v", item.src, err)
+			return nil
+		}
+	}
+	return aw.Close()
+}
+
+// uniqueName returns name, or if that is taken already, the first of
+// "name (1).ext", "name (2).ext" and so on that is not, and marks it
+// as taken. Files of the same name picked from different directories
+// would otherwise overwrite each other when the archive is unpacked.
+func uniqueName(taken map[string]bool, name string) string {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; taken[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	taken[name] = true
+	return name
+}
+
+// archiveBase returns name fit for naming an archive after it.
+// The root is named after the prefix it is mounted under, if any.
+func (fsrv *FileServer) archiveBase(name string) string {
+	if name == "" || name == "." || name == "/" {
+		if fsrv.Prefix != "" {
+			return path.Base(fsrv.Prefix)
+		}
+		return "download"
+	}
+	return name
+}
+
+// addToArchive adds the file called name in fileSystem to the archive
+// as rel.
+func (fsrv *FileServer) addToArchive(aw *archive.Writer, fileSystem fs.FS, name, rel string, entry fs.DirEntry) error {
+	if entry.IsDir() {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		return aw.AddDir(rel, info)
+	}
+
+	if entry.Type()&fs.ModeSymlink != 0 && !fsrv.insideRoot(name) {
+		return nil
+	}
+	// follows symbolic links
+	info, err := fs.Stat(fileSystem, name)
+	if err != nil || !info.Mode().IsRegular() {
+		// broken links, links to directories and special files
+		return nil
+	}
+	f, err := fileSystem.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return aw.AddFile(rel, info, f)
+}
+
+// insideRoot reports whether the file called name, relative to the
+// root, is still inside the root once symbolic links are followed,
+// so that links can't be used to download files from elsewhere.
+func (fsrv *FileServer) insideRoot(name string) bool {
+	if fsrv.FS != nil {
+		return true
+	}
+	root, err := filepath.EvalSymlinks(fsrv.Root)
+	if err != nil {
+		return false
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, real)
+	return err == nil && (rel == "." || filepath.IsLocal(rel))
+}
+
+// setDisposition makes the response download as a file called name,
+// or show in the browser with the disposition "inline".
+func setDisposition(w http.ResponseWriter, disposition, name string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+}
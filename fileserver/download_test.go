@@ -0,0 +1,103 @@
+package fileserver
+
+import (
+	"archive/tar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// archiveNames downloads query from fsrv as a tar archive and
+// returns the names of its entries.
+func archiveNames(t *testing.T, fsrv *FileServer, query url.Values) []string {
+	t.Helper()
+	query.Set("format", "tar")
+	r := httptest.NewRequest(http.MethodGet, "/_download?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	if err := fsrv.ServeDownload(w, r); err != nil {
+		t.Fatalf("download %s: %v", query.Encode(), err)
+	}
+	var names []string
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestArchiveSkipsOutsideLinks(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "dir"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{filepath.Join(root, "dir", "a.txt"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(name, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"dir/in":     filepath.Join(root, "dir", "a.txt"),
+		"dir/out":    filepath.Join(outside, "secret"),
+		"dir/outdir": outside,
+		"out":        filepath.Join(outside, "secret"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symbolic links are not supported: %v", err)
+		}
+	}
+	fsrv := &FileServer{Root: root}
+
+	names := archiveNames(t, fsrv, url.Values{"file": {"dir"}})
+	want := []string{"dir/", "dir/a.txt", "dir/in"}
+	if !slices.Equal(names, want) {
+		t.Errorf("archive holds %q, want %q", names, want)
+	}
+
+	for _, file := range []string{"out", "dir/outdir", "dir/out"} {
+		if status := download(fsrv, url.Values{"file": {file}}); status != http.StatusNotFound {
+			t.Errorf("download of %s: status %d, want %d", file, status, http.StatusNotFound)
+		}
+	}
+	if status := download(fsrv, url.Values{"file": {"dir/a.txt", "out"}}); status != http.StatusNotFound {
+		t.Errorf("selection with a link out of the root: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestSelectionNames(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a/x.txt", "b/x.txt", "c/x.txt", "x (1).txt"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsrv := &FileServer{Root: root}
+
+	names := archiveNames(t, fsrv, url.Values{
+		"file": {"a/x.txt", "x (1).txt", "b/x.txt", "c/x.txt"},
+		"name": {"pick"},
+	})
+	want := []string{"pick/x.txt", "pick/x (1).txt", "pick/x (2).txt", "pick/x (3).txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("archive holds %q, want %q", names, want)
+	}
+}
@@ -0,0 +1,277 @@
+package fileserver
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultMinCompressLength = 512
+
+// sidecarExts maps content codings to the extensions of the
+// precompressed files that hold their output.
+var sidecarExts = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// onTheFlyEncodings are the content codings responses are compressed
+// with on the fly, in order of preference.
+var onTheFlyEncodings = []string{"zstd", "gzip"}
+
+// acceptedEncodings returns those of offered that the client accepts
+// according to its Accept-Encoding header, the most wanted first.
+// Encodings the client likes equally keep the order of offered.
+func acceptedEncodings(r *http.Request, offered []string) []string {
+	qvalues := make(map[string]float64)
+	for _, field := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(field, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				var err error
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			if coding != "" {
+				qvalues[strings.ToLower(coding)] = q
+			}
+		}
+	}
+
+	var accepted []string
+	for _, coding := range offered {
+		q, ok := qvalues[coding]
+		if !ok {
+			q = qvalues["*"]
+		}
+		if q > 0 {
+			accepted = append(accepted, coding)
+		}
+	}
+	slices.SortStableFunc(accepted, func(a, b string) int {
+		qa, ok := qvalues[a]
+		if !ok {
+			qa = qvalues["*"]
+		}
+		qb, ok := qvalues[b]
+		if !ok {
+			qb = qvalues["*"]
+		}
+		switch {
+		case qa > qb:
+			return -1
+		case qa < qb:
+			return 1
+		}
+		return 0
+	})
+	return accepted
+}
+
+// openSidecar looks for a precompressed version of the file called
+// filename that the client accepts, and returns it with its coding.
+func (fsrv *FileServer) openSidecar(fileSystem fs.FS, filename string, r *http.Request) (fs.File, string) {
+	for _, coding := range acceptedEncodings(r, fsrv.Precompressed) {
+		ext, ok := sidecarExts[coding]
+		if !ok || fsrv.IsHidden(filename+ext) {
+			continue
+		}
+		file, err := fileSystem.Open(filename + ext)
+		if err != nil {
+			continue
+		}
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			return file, coding
+		}
+		file.Close()
+	}
+	return nil, ""
+}
+
+// compressResponse returns w wrapped to compress everything written
+// to it, if responses of contentType are to be compressed and the
+// client accepts it. It returns nil if the response is to go out as
+// is. The caller must close the returned writer.
+//
+// Range requests are never compressed, since the ranges would refer
+// to the uncompressed representation.
+func (fsrv *FileServer) compressResponse(w http.ResponseWriter, r *http.Request, contentType string, size int64) *compressWriter {
+	if !fsrv.Compress || !compressible(contentType) {
+		return nil
+	}
+	addVary(w.Header(), "Accept-Encoding")
+
+	minLength := fsrv.MinCompressLength
+	if minLength == 0 {
+		minLength = defaultMinCompressLength
+	}
+	if r.Header.Get("Range") != "" || size < minLength || w.Header().Get("Content-Encoding") != "" {
+		return nil
+	}
+	codings := acceptedEncodings(r, onTheFlyEncodings)
+	if len(codings) == 0 {
+		return nil
+	}
+
+	h := w.Header()
+	h.Set("Content-Encoding", codings[0])
+	h.Del("Content-Length")
+	if etag := h.Get("Etag"); etag != "" {
+		h.Set("Etag", encodedEtag(etag, codings[0]))
+	}
+	return &compressWriter{ResponseWriter: w, coding: codings[0]}
+}
+
+// compressible reports whether content of the given MIME type is
+// worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json",
+		"application/x-ndjson",
+		"application/javascript",
+		"application/x-javascript",
+		"application/xml",
+		"application/wasm",
+		"application/x-sh",
+		"application/toml",
+		"application/yaml",
+		"application/x-yaml":
+		return true
+	}
+	return false
+}
+
+// contentType determines the MIME type of file from the extension of
+// name or, failing that, by sniffing the first bytes of the file.
+func contentType(file io.ReadSeeker, name string) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	var buf [512]byte
+	n, _ := io.ReadFull(file, buf[:])
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// encodedEtag returns the etag of a representation with the given
+// content coding applied, which must differ from the etag of the
+// representation itself.
+func encodedEtag(etag, coding string) string {
+	if etag == "" || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + coding + `"`
+}
+
+// addVary adds field to the Vary header unless it is already there.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// compressWriter compresses the response body written through it.
+// The encoder is only set up once there is a body to write, so that
+// responses without one, such as 304 Not Modified, stay empty.
+type compressWriter struct {
+	http.ResponseWriter
+	coding string
+	enc    io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.Header().Get("Content-Encoding") != cw.coding {
+		// someone took the encoding back
+		cw.coding = ""
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.coding == "" {
+		return cw.ResponseWriter.Write(p)
+	}
+	if cw.enc == nil {
+		cw.enc = getEncoder(cw.coding, cw.ResponseWriter)
+	}
+	return cw.enc.Write(p)
+}
+
+// Close flushes what is left of the compressed body.
+func (cw *compressWriter) Close() error {
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	putEncoder(cw.coding, cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Encoders are expensive to set up, so they are reused.
+var (
+	gzipPool = sync.Pool{
+		New: func() any {
+			return gzip.NewWriter(nil)
+		},
+	}
+	zstdPool = sync.Pool{
+		New: func() any {
+			// a small window keeps browsers, which limit it, happy
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+			return enc
+		},
+	}
+)
+
+func getEncoder(coding string, w io.Writer) io.WriteCloser {
+	if coding == "zstd" {
+		enc := zstdPool.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return enc
+	}
+	enc := gzipPool.Get().(*gzip.Writer)
+	enc.Reset(w)
+	return enc
+}
+
+func putEncoder(coding string, enc io.WriteCloser) {
+	if coding == "zstd" {
+		zstdPool.Put(enc)
+		return
+	}
+	gzipPool.Put(enc)
+}
@@ -0,0 +1,70 @@
+package fileserver
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// inlineRequested reports whether the file called name is to be
+// shown in the browser rather than downloaded: if the "inline"
+// parameter says so or, without it, if the extension of name is one
+// of InlineExtensions.
+func (fsrv *FileServer) inlineRequested(r *http.Request, name string) bool {
+	if v := r.Form.Get("inline"); v != "" {
+		inline, _ := strconv.ParseBool(v)
+		return inline
+	}
+	return slices.ContainsFunc(fsrv.InlineExtensions, func(ext string) bool {
+		return strings.EqualFold(path.Ext(name), ext)
+	})
+}
+
+// inlineType determines the MIME type of the file at localPath from
+// its contents, falling back to the extension of its name for types
+// sniffing can't tell apart. It returns "" if the file must not be
+// shown inline, because browsers would run scripts in it.
+func inlineType(localPath string) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var buf [512]byte
+	n, _ := f.Read(buf[:])
+	sniffed := http.DetectContentType(buf[:n])
+	byExt := mime.TypeByExtension(path.Ext(localPath))
+	if activeContent(sniffed) || activeContent(byExt) {
+		return "", nil
+	}
+
+	ctype := sniffed
+	if byExt != "" && (strings.HasPrefix(sniffed, "text/plain") || sniffed == "application/octet-stream") {
+		ctype = byExt
+	}
+	return ctype, nil
+}
+
+// activeContent reports whether content of the given MIME type can
+// carry scripts that browsers run when showing it.
+func activeContent(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html",
+		"application/xhtml+xml",
+		"image/svg+xml",
+		"text/xml",
+		"application/xml",
+		"text/xsl",
+		"application/xslt+xml",
+		"text/javascript",
+		"application/javascript",
+		"application/x-shockwave-flash":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
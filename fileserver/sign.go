@@ -0,0 +1,149 @@
+package fileserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iupload/auth"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultLinkTTL = 24 * time.Hour
+
+// LoadSecret reads the secret that download links are signed with
+// from file, generating and storing a new one if there is none yet.
+func LoadSecret(file string) ([]byte, error) {
+	secret, err := os.ReadFile(file)
+	if err == nil && len(secret) > 0 {
+		return secret, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(file, secret, 0o600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// ServeSign mints a signed link to download the file named by the
+// "file" parameter, relative to "dir", as ServeDownload takes them.
+// The link expires after the duration in the "ttl" parameter, such
+// as "30m" or "72h". Default: 24h
+//
+// With SignedOnly set, links are what protects the files, so only
+// clients identified by a certificate may mint them.
+func (fsrv *FileServer) ServeSign(w http.ResponseWriter, r *http.Request) error {
+	if len(fsrv.Secret) == 0 {
+		return Error(http.StatusNotFound, errors.New("signed links are not enabled"))
+	}
+	if err := fsrv.Authorize(r); err != nil {
+		return err
+	}
+	if fsrv.SignedOnly && auth.User(r) == "" {
+		return Error(http.StatusForbidden, errors.New("a client certificate is required to sign links"))
+	}
+	if fsrv.DropBox {
+		return Error(http.StatusForbidden, ErrDropBox)
+	}
+	if err := r.ParseForm(); err != nil {
+		return Error(http.StatusBadRequest, err)
+	}
+	name, err := fsrv.downloadName(r.Form.Get("dir"), r.Form.Get("file"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(SanitizedPathJoin(fsrv.Root, name)); err != nil {
+		return Error(http.StatusNotFound, fmt.Errorf("file not found"))
+	}
+	ttl := defaultLinkTTL
+	if v := r.Form.Get("ttl"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			return Error(http.StatusBadRequest, fmt.Errorf("invalid ttl %q", v))
+		}
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("file", strings.TrimPrefix(path.Join(fsrv.Prefix, name), "/"))
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", fsrv.signature(name, expires))
+	link := "/_download?" + query.Encode()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(map[string]any{
+		"path":    BasePath(r) + link,
+		"url":     AbsoluteURL(r, link),
+		"expires": time.Unix(expires, 0).UTC(),
+	})
+}
+
+// checkSignature verifies the signature of a download of the files
+// called names, if the request carries one, and reports whether it
+// does. Links to more than one file are never signed. A signature is
+// required if SignedOnly is set.
+func (fsrv *FileServer) checkSignature(r *http.Request, names []string) (bool, error) {
+	sig, expiresParam := r.Form.Get("sig"), r.Form.Get("expires")
+	if sig == "" && expiresParam == "" {
+		if fsrv.SignedOnly {
+			return false, Error(http.StatusForbidden, errors.New("downloads require a signed link"))
+		}
+		return false, nil
+	}
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil || len(fsrv.Secret) == 0 || len(names) != 1 ||
+		!hmac.Equal([]byte(sig), []byte(fsrv.signature(names[0], expires))) {
+		return false, Error(http.StatusForbidden, errors.New("invalid link signature"))
+	}
+	if time.Now().Unix() > expires {
+		return false, Error(http.StatusGone, errors.New("link has expired"))
+	}
+	return true, nil
+}
+
+// signature returns the signature of a link to the file called
+// name, relative to the root, that expires at the given Unix time.
+// It covers the prefix too, so links don't carry over to other file
+// servers with the same secret.
+func (fsrv *FileServer) signature(name string, expires int64) string {
+	name = strings.TrimPrefix(path.Join(fsrv.Prefix, name), "/")
+	mac := hmac.New(sha256.New, fsrv.Secret)
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// downloadName returns the name of the file to download, relative
+// to the root, from the parameters of a download request.
+func (fsrv *FileServer) downloadName(dir, name string) (string, error) {
+	if name == "" {
+		return "", Error(http.StatusBadRequest, fmt.Errorf("no file given"))
+	}
+	if strings.Contains(dir, "..") || strings.Contains(name, "..") {
+		return "", Error(http.StatusBadRequest, fmt.Errorf("Invalid filename. Please check and try again."))
+	}
+	name = path.Join(dir, name)
+	if fsrv.IsHidden(name) {
+		return "", Error(http.StatusBadRequest, fmt.Errorf("Invalid filename. Please check and try again."))
+	}
+	return path.Clean("/" + name)[1:], nil
+}
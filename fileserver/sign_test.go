@@ -0,0 +1,138 @@
+package fileserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// statusOf returns the status code that err would be answered with.
+func statusOf(err error) int {
+	var he HandlerError
+	if errors.As(err, &he) {
+		return he.StatusCode
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+func newSigningServer(t *testing.T) *FileServer {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &FileServer{Root: root, Secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func download(fsrv *FileServer, query url.Values) int {
+	r := httptest.NewRequest(http.MethodGet, "/_download?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	if err := fsrv.ServeDownload(w, r); err != nil {
+		return statusOf(err)
+	}
+	return w.Code
+}
+
+func TestSignedLinks(t *testing.T) {
+	fsrv := newSigningServer(t)
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	link := func(name, file string, expires, signedExpires int64) url.Values {
+		return url.Values{
+			"file":    {file},
+			"expires": {strconv.FormatInt(expires, 10)},
+			"sig":     {fsrv.signature(name, signedExpires)},
+		}
+	}
+	tampered := link("a.txt", "a.txt", future, future)
+	tampered.Set("sig", tampered.Get("sig")[1:]+"A")
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		status int
+	}{
+		{"valid", link("a.txt", "a.txt", future, future), http.StatusOK},
+		{"tampered signature", tampered, http.StatusForbidden},
+		{"other file", link("a.txt", "b.txt", future, future), http.StatusForbidden},
+		{"extended expiry", link("a.txt", "a.txt", future+3600, future), http.StatusForbidden},
+		{"expired", link("a.txt", "a.txt", past, past), http.StatusGone},
+		{"bad expiry", url.Values{"file": {"a.txt"}, "expires": {"soon"}, "sig": {"x"}}, http.StatusForbidden},
+		{"signature only", url.Values{"file": {"a.txt"}, "sig": {fsrv.signature("a.txt", 0)}}, http.StatusForbidden},
+		{"several files", url.Values{"file": {"a.txt", "b.txt"}, "expires": {strconv.FormatInt(future, 10)}, "sig": {fsrv.signature("a.txt", future)}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := download(fsrv, tt.query); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+
+	// links don't carry over to file servers under other prefixes
+	other := *fsrv
+	other.Prefix = "/other"
+	if status := download(&other, link("a.txt", "a.txt", future, future)); status != http.StatusForbidden {
+		t.Errorf("other prefix: status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestSignedOnly(t *testing.T) {
+	fsrv := newSigningServer(t)
+	fsrv.SignedOnly = true
+	fsrv.Users = []string{"alice"}
+	future := time.Now().Add(time.Hour).Unix()
+
+	if status := download(fsrv, url.Values{"file": {"a.txt"}}); status != http.StatusForbidden {
+		t.Errorf("unsigned: status %d, want %d", status, http.StatusForbidden)
+	}
+	// a valid link stands in for the certificate of one of Users
+	signed := url.Values{
+		"file":    {"a.txt"},
+		"expires": {strconv.FormatInt(future, 10)},
+		"sig":     {fsrv.signature("a.txt", future)},
+	}
+	if status := download(fsrv, signed); status != http.StatusOK {
+		t.Errorf("signed: status %d, want %d", status, http.StatusOK)
+	}
+
+	// links are not minted for clients without a certificate
+	r := httptest.NewRequest(http.MethodGet, "/_sign?file=a.txt", nil)
+	if status := statusOf(fsrv.ServeSign(httptest.NewRecorder(), r)); status != http.StatusForbidden {
+		t.Errorf("signing anonymously: status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestDownloadName(t *testing.T) {
+	fsrv := &FileServer{Root: t.TempDir(), Hide: []string{"/secret"}}
+	tests := []struct {
+		dir, name string
+		want      string
+		status    int
+	}{
+		{"", "a.txt", "a.txt", http.StatusOK},
+		{"builds", "v1/a.txt", "builds/v1/a.txt", http.StatusOK},
+		{"", "/builds/a.txt", "builds/a.txt", http.StatusOK},
+		{"", "", "", http.StatusBadRequest},
+		{"", "../a.txt", "", http.StatusBadRequest},
+		{"builds", "../../a.txt", "", http.StatusBadRequest},
+		{"..", "a.txt", "", http.StatusBadRequest},
+		{"sub", "../a.txt", "", http.StatusBadRequest},
+		{"", "secret", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		got, err := fsrv.downloadName(tt.dir, tt.name)
+		if status := statusOf(err); status != tt.status || got != tt.want {
+			t.Errorf("downloadName(%q, %q) = %q, %d; want %q, %d", tt.dir, tt.name, got, status, tt.want, tt.status)
+		}
+	}
+}
@@ -3,15 +3,32 @@ package fileserver
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
-	"os"
 	"path"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	if err := fsrv.Authorize(r); err != nil {
+		return err
+	}
+	if fsrv.Prefix != "" {
+		rest, ok := strings.CutPrefix(r.URL.Path, fsrv.Prefix)
+		if !ok || (rest != "" && rest[0] != '/') {
+			return Error(http.StatusNotFound, fs.ErrNotExist)
+		}
+		if rest == "" {
+			return redirect(w, r, fsrv.Prefix+"/")
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path, r.URL.RawPath = rest, ""
+	}
 	if runtime.GOOS == "windows" {
 		// reject paths with Alternate Data Streams (ADS)
 		if strings.Contains(r.URL.Path, ":") {
@@ -23,17 +40,166 @@ func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) error
 			return Error(http.StatusBadRequest, fmt.Errorf("illegal short name"))
 		}
 	}
+	if fsrv.IsHidden(r.URL.Path) {
+		return Error(http.StatusNotFound, fs.ErrNotExist)
+	}
 	root := ""
 	filename := strings.TrimSuffix(SanitizedPathJoin(root, r.URL.Path), "/")
-	fsFs := os.DirFS(fsrv.Root)
-	fileSystem := os.DirFS(fsrv.Root)
-	info, err := fs.Stat(fsFs, filename)
+	fileSystem := fsrv.fileSystem()
+	info, err := fs.Stat(fileSystem, filename)
+	if err != nil {
+		return mapDirOpenError(err)
+	}
+
+	if info.IsDir() {
+		if fsrv.DropBox {
+			// an uploaded index file must not take over the drop box
+			return fsrv.serveBrowse(fileSystem, root, filename, w, r)
+		}
+		// a directory with an index file is served as that file
+		if indexFile := fsrv.findIndex(fileSystem, filename, r.URL.Path); indexFile != "" {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				return redirect(w, r, fsrv.Prefix+r.URL.Path+"/")
+			}
+			return fsrv.serveFile(fileSystem, indexFile, w, r)
+		}
+		if fsrv.Browse != nil {
+			return fsrv.serveBrowse(fileSystem, root, filename, w, r)
+		}
+		return Error(http.StatusNotFound, fs.ErrNotExist)
+	}
+
+	if fsrv.DropBox {
+		return Error(http.StatusNotFound, fs.ErrNotExist)
+	}
+
+	// files are not directories, so their paths don't end in a slash
+	if strings.HasSuffix(r.URL.Path, "/") {
+		return redirect(w, r, fsrv.Prefix+strings.TrimSuffix(r.URL.Path, "/"))
+	}
+	return fsrv.serveFile(fileSystem, filename, w, r)
+}
+
+// ServeFile serves the regular file called name, relative to the
+// root, whatever the request path is.
+func (fsrv *FileServer) ServeFile(w http.ResponseWriter, r *http.Request, name string) error {
+	if fsrv.IsHidden(name) {
+		return Error(http.StatusNotFound, fs.ErrNotExist)
+	}
+	filename := strings.TrimSuffix(SanitizedPathJoin("", name), "/")
+	fileSystem := fsrv.fileSystem()
+	info, err := fs.Stat(fileSystem, filename)
+	if err != nil {
+		return mapDirOpenError(err)
+	}
+	if !info.Mode().IsRegular() {
+		return Error(http.StatusNotFound, fmt.Errorf("%s is not a regular file", name))
+	}
+	return fsrv.serveFile(fileSystem, filename, w, r)
+}
+
+// findIndex returns the name of the first of IndexNames that exists
+// as a file in the directory dirPath, or "" if none does.
+func (fsrv *FileServer) findIndex(fileSystem fs.FS, dirPath, urlPath string) string {
+	for _, indexName := range fsrv.IndexNames {
+		if fsrv.IsHidden(path.Join(urlPath, indexName)) {
+			continue
+		}
+		indexPath := path.Join(dirPath, indexName)
+		info, err := fs.Stat(fileSystem, indexPath)
+		if err == nil && !info.IsDir() {
+			return indexPath
+		}
+	}
+	return ""
+}
+
+// isIndexName reports whether name is one of IndexNames.
+func (fsrv *FileServer) isIndexName(name string) bool {
+	return slices.Contains(fsrv.IndexNames, name)
+}
+
+// serveFile serves the regular file called filename. Range requests
+// and conditional requests based on modification time and ETag are
+// handled by http.ServeContent. If the client accepts it, a
+// precompressed sidecar file is served in its place, or else the
+// file is compressed on the fly if it is of a compressible type.
+func (fsrv *FileServer) serveFile(fileSystem fs.FS, filename string, w http.ResponseWriter, r *http.Request) error {
+	file, err := fileSystem.Open(filename)
+	if err != nil {
+		return mapDirOpenError(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
 	if err != nil {
 		return Error(http.StatusInternalServerError, err)
 	}
-	if info.IsDir() && fsrv.Browse != nil {
-		return fsrv.serveBrowse(fileSystem, root, filename, w, r)
-	} else {
-		return errors.New("browse error")
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return Error(http.StatusInternalServerError, fmt.Errorf("%s is not seekable", filename))
+	}
+
+	// the type is that of the file, whichever encoding it is sent in
+	ctype, err := contentType(content, info.Name())
+	if err != nil {
+		return Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", ctype)
+	// uploaded pages must not run scripts on this origin, which the
+	// API lives on too; only index files may be trusted to
+	if activeContent(ctype) && !(fsrv.TrustedIndex && fsrv.isIndexName(info.Name())) {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	if len(fsrv.Precompressed) > 0 {
+		addVary(w.Header(), "Accept-Encoding")
+		if sidecar, coding := fsrv.openSidecar(fileSystem, filename, r); sidecar != nil {
+			defer sidecar.Close()
+			if sidecarContent, ok := sidecar.(io.ReadSeeker); ok {
+				sidecarInfo, err := sidecar.Stat()
+				if err != nil {
+					return Error(http.StatusInternalServerError, err)
+				}
+				w.Header().Set("Content-Encoding", coding)
+				w.Header().Set("Etag", encodedEtag(calculateEtag(sidecarInfo), coding))
+				http.ServeContent(w, r, info.Name(), sidecarInfo.ModTime(), sidecarContent)
+				return nil
+			}
+		}
+	}
+
+	w.Header().Set("Etag", calculateEtag(info))
+	if cw := fsrv.compressResponse(w, r, ctype, info.Size()); cw != nil {
+		defer cw.Close()
+		w = cw
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+	return nil
+}
+
+// calculateEtag produces a strong etag by default, although, for
+// efficiency reasons, it does not actually consume the contents
+// of the file to make a hash of all the bytes.
+func calculateEtag(info fs.FileInfo) string {
+	mtime := info.ModTime()
+	if mtime.IsZero() || mtime.Equal(time.Unix(0, 0)) {
+		return ""
+	}
+	t := strconv.FormatInt(mtime.UnixNano(), 36)
+	s := strconv.FormatInt(info.Size(), 36)
+	return `"` + t + s + `"`
+}
+
+// mapDirOpenError maps the error from opening or stating a file
+// to a handler error with a fitting status code.
+func mapDirOpenError(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return Error(http.StatusNotFound, err)
+	case errors.Is(err, fs.ErrPermission):
+		return Error(http.StatusForbidden, err)
 	}
+	return Error(http.StatusInternalServerError, err)
 }
@@ -0,0 +1,49 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestActiveContentSandbox(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"index.html": "<script>alert(1)</script>",
+		"page.html":  "<script>alert(1)</script>",
+		"image.svg":  `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"notes.txt":  "hello",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		target  string
+		trusted bool
+		sandbox bool
+	}{
+		{"/index.html", false, true},
+		{"/", false, true},
+		{"/page.html", false, true},
+		{"/image.svg", false, true},
+		{"/notes.txt", false, false},
+		{"/", true, false},
+		{"/page.html", true, true},
+	}
+	for _, tt := range tests {
+		fsrv := &FileServer{Root: root, IndexNames: []string{"index.html"}, TrustedIndex: tt.trusted}
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		w := httptest.NewRecorder()
+		if err := fsrv.ServeHTTP(w, r); err != nil {
+			t.Fatalf("GET %s: %v", tt.target, err)
+		}
+		if sandbox := w.Header().Get("Content-Security-Policy") == "sandbox"; sandbox != tt.sandbox {
+			t.Errorf("GET %s (trusted index %v): sandbox %v, want %v", tt.target, tt.trusted, sandbox, tt.sandbox)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"iupload/auth"
+	"net/http"
+)
+
+// ErrDropBox is returned for attempts to fetch files from a drop box.
+var ErrDropBox = errors.New("files cannot be fetched from a drop box")
+
+// Authorize refuses r with 403 Forbidden unless it comes from one of
+// Users.
+func (fsrv *FileServer) Authorize(r *http.Request) error {
+	user := auth.User(r)
+	if auth.Allowed(user, fsrv.Users) {
+		return nil
+	}
+	if user == "" {
+		return Error(http.StatusForbidden, errors.New("a client certificate is required"))
+	}
+	return Error(http.StatusForbidden, fmt.Errorf("%s may not access these files", user))
+}
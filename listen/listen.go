@@ -0,0 +1,221 @@
+// Package listen opens the sockets that the server accepts
+// connections on: TCP addresses, Unix domain sockets, and sockets
+// passed on by systemd socket activation.
+package listen
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefixes of addresses that are not TCP addresses.
+const (
+	// UnixPrefix starts the addresses of Unix domain sockets, such
+	// as "unix:/run/iupload.sock".
+	UnixPrefix = "unix:"
+
+	// SystemdPrefix starts the addresses of sockets passed by systemd:
+	// "systemd:" for all of them, or "systemd:name" for those with
+	// FileDescriptorName=name in the socket unit.
+	SystemdPrefix = "systemd:"
+)
+
+// Check returns an error if addr is not an address that Open can
+// listen on.
+func Check(addr string) error {
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		if path == "" {
+			return fmt.Errorf("no socket path in %q", addr)
+		}
+		return nil
+	}
+	if strings.HasPrefix(addr, SystemdPrefix) {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Open listens on all of addrs. Unix domain sockets are given the
+// permissions in mode, unless it is zero; stale socket files left
+// behind by an earlier run are replaced. If any address cannot be
+// listened on, the listeners opened so far are closed again.
+func Open(addrs []string, mode fs.FileMode) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		ls, err := open(addr, mode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listening on %s: %w", addr, err)
+		}
+		listeners = append(listeners, ls...)
+	}
+	return listeners, nil
+}
+
+func open(addr string, mode fs.FileMode) ([]net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, UnixPrefix); ok {
+		l, err := openUnix(path, mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	if name, ok := strings.CutPrefix(addr, SystemdPrefix); ok {
+		return systemd(name)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+// openUnix listens on the Unix domain socket at path.
+func openUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		// nothing can be listening on it any more if we can dial it
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("socket is in use")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	if mode == 0 {
+		return net.Listen("unix", path)
+	}
+
+	// the socket gets its permissions in a private directory before
+	// it is moved into place, so that it is never reachable with the
+	// ones the umask leaves it
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".iupload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Close would remove the socket under its old name
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener removes its socket, which was moved into place after
+// listening on it, when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Addr reports the path the socket was moved to.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+var inherited struct {
+	sync.Once
+	files map[string][]*os.File
+	err   error
+}
+
+// systemd returns the listeners for the sockets that systemd passed
+// under name, or all of them if name is empty. Each socket can only
+// be taken once.
+func systemd(name string) ([]net.Listener, error) {
+	inherited.Do(func() {
+		inherited.files, inherited.err = inherit()
+	})
+	if inherited.err != nil {
+		return nil, inherited.err
+	}
+	var names []string
+	if name != "" {
+		names = []string{name}
+	} else {
+		for name := range inherited.files {
+			names = append(names, name)
+		}
+	}
+	var listeners []net.Listener
+	for _, name := range names {
+		for _, f := range inherited.files[name] {
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, l)
+		}
+		delete(inherited.files, name)
+	}
+	if len(listeners) == 0 && name != "" {
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	if len(listeners) == 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	return listeners, nil
+}
+
+// inherit takes the sockets that systemd passed to the process, by
+// their names. The environment variables describing them are removed
+// so that child processes do not take them for their own.
+func inherit() (map[string][]*os.File, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, errors.New("no sockets passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make(map[string][]*os.File)
+	for i := range n {
+		// systemd names sockets "unknown" unless told otherwise
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fd := uintptr(listenFdsStart + i)
+		files[name] = append(files[name], os.NewFile(fd, name))
+	}
+	return files, nil
+}
@@ -0,0 +1,68 @@
+//go:build unix
+
+package listen
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "iupload.sock")
+
+	l, err := openUnix(path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Addr().String(); got != path {
+		t.Errorf("Addr = %s, want %s", got, path)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Type() != fs.ModeSocket || info.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode %v, want a socket with 0660", info.Mode())
+	}
+	// the private directory the socket was made in is gone
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries in the socket's directory, want 1", len(entries))
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dialing the socket: %v", err)
+	}
+	conn.Close()
+
+	if _, err := openUnix(path, 0o660); err == nil {
+		t.Error("listening on a socket in use succeeded")
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket still there after Close: %v", err)
+	}
+}
+
+func TestOpenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iupload.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leave the socket file behind, as a crashed server would
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := openUnix(path, 0)
+	if err != nil {
+		t.Fatalf("replacing a stale socket: %v", err)
+	}
+	l.Close()
+}
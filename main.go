@@ -1,122 +1,345 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io/fs"
+	"iupload/auth"
+	"iupload/certs"
+	"iupload/client"
+	"iupload/config"
+	"iupload/digest"
 	"iupload/fileserver"
+	"iupload/listen"
+	"iupload/mount"
+	"iupload/share"
+	"iupload/throttle"
+	"iupload/upload"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const STATIC_FOLDER = "static"
+// 进行中的请求，停止服务时等待其结束后再清理临时文件
+var inflight requests
 
-// 静态文件中间件
-func staticFileMiddleware() gin.HandlerFunc {
+// 进行中的请求计数。开始等待后不再计入新请求，以免 WaitGroup 的
+// Add 与 Wait 并发
+type requests struct {
+	mu       sync.RWMutex
+	stopping bool
+	wg       sync.WaitGroup
+}
+
+// 计入一个新请求；已在停止服务时返回 false
+func (q *requests) start() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.stopping {
+		return false
+	}
+	q.wg.Add(1)
+	return true
+}
+
+func (q *requests) done() {
+	q.wg.Done()
+}
+
+// 拒绝之后的请求，并等待已计入的请求结束
+func (q *requests) wait() {
+	q.mu.Lock()
+	q.stopping = true
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// 将返回 error 的处理函数包装为 gin 处理函数，错误以 JSON 形式返回
+func handle(h func(http.ResponseWriter, *http.Request) error) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 将请求路径映射到静态文件目录
-		requestPath := c.Request.URL.Path
-		fullPath := filepath.Join(STATIC_FOLDER, requestPath)
-		// 检查文件是否存在并返回文件
-		if _, err := filepath.Abs(fullPath); err == nil {
-			http.ServeFile(c.Writer, c.Request, fullPath)
-			c.Abort()
-		} else {
-			c.Next()
+		if !inflight.start() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "the server is shutting down"})
+			return
+		}
+		defer inflight.done()
+		err := h(c.Writer, c.Request)
+		if err == nil {
+			return
 		}
+		log.Printf("%s %s: %s\n", c.Request.Method, c.Request.URL.Path, err.Error())
+		if c.Writer.Written() {
+			return
+		}
+		status, message := http.StatusInternalServerError, err.Error()
+		var he fileserver.HandlerError
+		if errors.As(err, &he) {
+			status = he.StatusCode
+			if he.Err != nil {
+				message = he.Err.Error()
+			}
+		}
+		c.JSON(status, gin.H{"error": message})
 	}
 }
+
 func main() {
-	_serve := &fileserver.FileServer{
-		Root:       STATIC_FOLDER,
-		Browse:     &fileserver.Browse{},
-		IndexNames: []string{"index.html"},
+	// 客户端子命令：push、pull、ls、rm、mkdir
+	if len(os.Args) > 1 && client.IsCommand(os.Args[1]) {
+		os.Exit(client.Main(os.Args[1:]))
 	}
-	gin.SetMode(gin.DebugMode)
-	// 创建一个默认的 Gin 路由器
-	router := gin.Default()
 
-	// 设置下载文件的路由
-	router.GET("/_download", func(c *gin.Context) {
-		id := c.Query("file")
-		if strings.Contains(id, "..") {
-			c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid filename. Please check and try again."})
-		} else {
-			savePath := filepath.Join(".", STATIC_FOLDER)
-			_, notExistErr := os.Stat(savePath)
-			if os.IsNotExist(notExistErr) {
-				_ = os.MkdirAll(savePath, os.ModePerm)
+	// 配置：默认值 < 配置文件 < 环境变量 < 命令行参数
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("configuration: %v", err)
+	}
+
+	// 文件摘要缓存，上传时计算的摘要供下载时使用
+	digests := &digest.Cache{}
+	// 下载链接签名密钥，首次启动时生成
+	secret, err := fileserver.LoadSecret(filepath.Join(cfg.DataDir, "secret"))
+	if err != nil {
+		log.Fatalf("loading link signing secret: %v", err)
+	}
+	// 分享链接，保存在数据目录的 shares.json 中
+	shares, err := share.Open(filepath.Join(cfg.DataDir, "shares.json"))
+	if err != nil {
+		log.Fatalf("loading shares: %v", err)
+	}
+	router, err := newRouter(cfg, digests, secret, shares)
+	if err != nil {
+		log.Fatalf("configuration: %v", err)
+	}
+	var handler swapHandler
+	handler.Store(withBasePath(cfg, router))
+
+	// 启动服务器：可同时监听多个 TCP 地址、Unix 套接字和 systemd 传入的套接字
+	listeners, err := listen.Open(cfg.Listen, fs.FileMode(cfg.SocketMode))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	server := &http.Server{
+		Handler:     &handler,
+		ConnContext: throttle.ConnContext,
+		TLSConfig:   &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	scheme, serve := "HTTP", server.Serve
+	if cfg.TLS.Enabled() {
+		// 验证客户端证书；签名链接和分享链接无需证书，其余请求在路由中要求证书
+		if cfg.TLS.ClientCA != "" {
+			pool, err := certs.Pool(cfg.TLS.ClientCA)
+			if err != nil {
+				log.Fatalf("loading client CA: %v", err)
 			}
-			localPath := filepath.Join(savePath, id)
-			fileInfo, fileExistErr := os.Stat(localPath)
-			if os.IsNotExist(fileExistErr) {
-				c.JSON(http.StatusBadRequest, gin.H{"message": "file not found"})
-			} else {
-				// 对文件名进行 URL 编码
-				encodedFilename := url.QueryEscape(fileInfo.Name())
-				c.Writer.Header().Set("Content-Disposition", "attachment; filename=\""+fileInfo.Name()+"\"; filename*=UTF-8''"+encodedFilename)
-				c.Writer.Header().Set("Content-Type", "application/octet-stream")
-				http.ServeFile(c.Writer, c.Request, localPath)
+			server.TLSConfig.ClientCAs = pool
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		certFile, keyFile := cfg.TLS.Cert, cfg.TLS.Key
+		if cfg.TLS.SelfSigned {
+			// 自签名证书首次启动时生成，保存在数据目录
+			if certFile, keyFile, err = certs.SelfSigned(cfg.DataDir, cfg.TLS.Hosts); err != nil {
+				log.Fatalf("self-signed certificate: %v", err)
 			}
 		}
-	})
-	// 设置文件上传的路由
-	router.POST("/_upload", func(c *gin.Context) {
-		// 从请求中获取文件
-		// 限制最大内存使用数量为 1MB ，不是限制客户端上传的文件大小
-		err := c.Request.ParseMultipartForm(1 << 20)
+		fingerprint, pin, err := certs.Fingerprints(certFile)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
+			log.Fatalf("reading certificate: %v", err)
 		}
-		// 遍历所有上传的文件字段
-		for key, fileHeaders := range c.Request.MultipartForm.File {
-			for _, file := range fileHeaders {
-				// 打印文件名称
-				log.Printf("Received %s=%s\n", key, file.Filename)
-				savePath := filepath.Join(".", STATIC_FOLDER)
-				_, notExistErr := os.Stat(savePath)
-				if os.IsNotExist(notExistErr) {
-					_ = os.MkdirAll(savePath, os.ModePerm)
-				}
-				// 保存文件到指定目录（当前目录）
-				dst := filepath.Join(".", STATIC_FOLDER, file.Filename)
-				if err := c.SaveUploadedFile(file, dst); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"error": err.Error(),
-					})
-					return
-				}
+		log.Printf("Certificate SHA-256 fingerprint: %s\n", fingerprint)
+		log.Printf("Pin with: curl --pinnedpubkey '%s'\n", pin)
+		scheme, serve = "HTTPS", func(l net.Listener) error { return server.ServeTLS(l, certFile, keyFile) }
+	}
+	for _, l := range listeners {
+		log.Printf("Listening and serving %s on %s\n", scheme, l.Addr())
+		go func() {
+			if err := serve(l); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Failed to start: %s", err.Error())
 			}
+		}()
+	}
+
+	// SIGHUP 重新加载配置，SIGINT、SIGTERM 停止服务
+	limits := cfg.Throttle
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		// 监听地址、套接字权限、数据目录和 TLS 设置需重启后生效
+		next, err := config.Load(os.Args[1:])
+		if err != nil {
+			log.Printf("Reloading configuration: %v; keeping the current one\n", err)
+			continue
+		}
+		if !slices.Equal(next.Listen, cfg.Listen) || next.SocketMode != cfg.SocketMode || next.DataDir != cfg.DataDir || !reflect.DeepEqual(next.TLS, cfg.TLS) {
+			log.Printf("Changes to listen, socket_mode, data_dir and tls take effect after a restart\n")
+		}
+		router, err := newRouter(next, digests, secret, shares)
+		if err != nil {
+			log.Printf("Reloading configuration: %v; keeping the current one\n", err)
+			continue
 		}
+		// 沿用全局限速的令牌桶，重新加载不重置带宽限制
+		next.Throttle.CarryOver(limits)
+		limits = next.Throttle
+		handler.Store(withBasePath(next, router))
+		cfg.ShutdownTimeout = next.ShutdownTimeout
+		log.Printf("Configuration reloaded\n")
+	}
+
+	// 再次收到信号时直接退出
+	signal.Stop(signals)
+
+	// 不再接受新连接，等待进行中的传输完成，超时后强制断开
+	log.Printf("Shutting down, waiting up to %s for transfers to finish\n", time.Duration(cfg.ShutdownTimeout))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Cutting transfers short: %v\n", err)
+		server.Close()
+	}
+	// Close 不等待处理函数返回；断开连接后它们很快出错返回，
+	// 此后才开始处理的请求以 503 拒绝
+	inflight.wait()
+	// 删除被中断的上传留下的临时文件
+	upload.RemovePartial()
+}
 
-		c.JSON(http.StatusOK, gin.H{
-			"message": "uploaded successfully!",
+// 经反向代理访问时的路径前缀；转发头仅在来自 trusted_proxies 时采信
+func withBasePath(cfg *config.Config, router http.Handler) http.Handler {
+	// 配置校验时已解析过，不会出错
+	proxies, _ := fileserver.ParseProxies(cfg.TrustedProxies)
+	return fileserver.StripBasePath(cfg.BasePath, proxies, router)
+}
+
+// 可替换的处理器，重新加载配置时换用新的路由而不中断监听
+type swapHandler struct {
+	atomic.Value
+}
+
+func (h *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// 是否为签名下载链接或分享链接的请求，这类请求凭链接本身访问
+func linkRequest(r *http.Request) bool {
+	switch {
+	case r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return false
+	case r.URL.Path == "/_download":
+		return r.URL.Query().Get("sig") != ""
+	}
+	return strings.HasPrefix(r.URL.Path, "/s/")
+}
+
+// 根据配置创建路由；重新加载配置时重新创建，摘要缓存、签名密钥和分享沿用
+func newRouter(cfg *config.Config, digests *digest.Cache, secret []byte, shares *share.Store) (*gin.Engine, error) {
+	// 挂载的目录；未配置 mounts 时只提供根目录
+	var mounts []*mount.Mount
+	if len(cfg.Mounts) == 0 {
+		mounts = append(mounts, &mount.Mount{Files: &cfg.FileServer, Upload: cfg.Upload, Mode: cfg.Mode})
+	}
+	for _, m := range cfg.Mounts {
+		mounts = append(mounts, &mount.Mount{Path: m.Path, Files: &m.FileServer, Upload: m.Upload, Mode: m.Mode})
+	}
+	for _, m := range mounts {
+		// 隐藏未完成的上传文件
+		m.Files.Hide = append(m.Files.Hide, upload.TempPrefix+"*")
+		if m.Upload != nil {
+			m.Upload.Digests = digests
+			m.Files.Hide = append(m.Files.Hide, "/"+m.Upload.StateDirName())
+		}
+		m.Files.Digests = digests
+		m.Files.Secret = secret
+	}
+	_serve, err := mount.New(mounts)
+	if err != nil {
+		return nil, err
+	}
+	_share := &share.Handler{Store: shares, Resolve: _serve.Resolve, Prefix: "/s", Admins: cfg.Admins}
+	// 带宽限制，已认证用户与匿名客户端分别设置
+	limits := cfg.Throttle
+	// 持有客户端证书的用户视为已认证
+	limits.IsAuthenticated = func(r *http.Request) bool { return auth.User(r) != "" }
+	if cfg.Debug {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	// 创建一个默认的 Gin 路由器
+	router := gin.Default()
+	// 双向 TLS：根据客户端证书识别用户
+	if cfg.TLS != nil && cfg.TLS.ClientCA != "" {
+		router.Use(func(c *gin.Context) {
+			c.Request = auth.Identify(c.Request, cfg.TLS.UserField)
+			// 没有客户端证书时只能使用签名下载链接和分享链接
+			if auth.User(c.Request) == "" && !linkRequest(c.Request) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "a client certificate is required"})
+			}
 		})
+	}
+
+	// 设置下载文件的路由，目录会打包为压缩文件下载
+	router.GET("/_download", handle(limits.Wrap(_serve.ServeDownload)))
+	// 多选文件打包下载
+	router.POST("/_download", handle(limits.Wrap(_serve.ServeDownload)))
+	// 生成带有效期的签名下载链接
+	router.GET("/_sign", handle(_serve.ServeSign))
+	router.POST("/_sign", handle(_serve.ServeSign))
+	// 管理分享链接：创建、列出、撤销
+	router.POST("/_shares", handle(_share.ServeCreate))
+	router.GET("/_shares", handle(_share.ServeList))
+	router.DELETE("/_shares/:id", handle(_share.ServeRevoke))
+	// 访问分享的文件或目录
+	router.GET("/s/:id", handle(limits.Wrap(_share.ServeShare)))
+	router.GET("/s/:id/*path", handle(limits.Wrap(_share.ServeShare)))
+	router.HEAD("/s/:id", handle(limits.Wrap(_share.ServeShare)))
+	router.HEAD("/s/:id/*path", handle(limits.Wrap(_share.ServeShare)))
+	// 设置文件上传的路由
+	router.POST("/_upload", func(c *gin.Context) {
+		// 断点续传（tus 协议）创建上传
+		if upload.IsTus(c.Request) {
+			handle(limits.Wrap(_serve.ServeTus))(c)
+			return
+		}
+		handle(limits.Wrap(_serve.ServeMultipart))(c)
 	})
 
+	// 断点续传（tus 协议）：查询偏移、追加数据、终止上传
+	router.OPTIONS("/_upload", handle(limits.Wrap(_serve.ServeTus)))
+	router.HEAD("/_upload/:id", handle(limits.Wrap(_serve.ServeTus)))
+	router.PATCH("/_upload/:id", handle(limits.Wrap(_serve.ServeTus)))
+	router.DELETE("/_upload/:id", handle(limits.Wrap(_serve.ServeTus)))
+
+	// 创建目录、删除文件
+	router.POST("/_mkdir", handle(_serve.ServeMkdir))
+	router.POST("/_rm", handle(_serve.ServeRemove))
+
 	// 中间件来处理静态文件请求，排除 /download 路径
 	router.NoRoute(func(c *gin.Context) {
-		if c.Request.URL.Path == "/_upload" || c.Request.URL.Path == "/_download" {
+		if c.Request.URL.Path == "/_upload" || strings.HasPrefix(c.Request.URL.Path, "/_upload/") || c.Request.URL.Path == "/_download" || c.Request.URL.Path == "/_sign" || c.Request.URL.Path == "/_shares" || c.Request.URL.Path == "/_mkdir" || c.Request.URL.Path == "/_rm" {
 			c.Next()
 		} else {
-			err := _serve.ServeHTTP(c.Writer, c.Request)
-			if err != nil {
-				c.JSON(200, gin.H{"msg": err.Error()})
-			}
+			handle(limits.Wrap(_serve.ServeHTTP))(c)
 		}
 	})
-
-	// 启动服务器
-	address := ":44321"
-	log.Printf("Listening and serving HTTP on %s\n", address)
-	err := router.Run(address)
-	if err != nil {
-		log.Printf("Failed to start: %s", err.Error())
-	}
+	return router, nil
 }
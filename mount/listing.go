@@ -0,0 +1,79 @@
+package mount
+
+import (
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"time"
+)
+
+// listingFS is a file system holding an empty directory for each
+// mount, named after its path, with the modification time of the
+// mount's root.
+type listingFS map[string]time.Time
+
+func (l listingFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		d := &listingDir{info: dirInfo{name: "."}}
+		for p, modTime := range l {
+			d.entries = append(d.entries, dirInfo{name: p, modTime: modTime})
+			if modTime.After(d.info.modTime) {
+				d.info.modTime = modTime
+			}
+		}
+		slices.SortFunc(d.entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+		return d, nil
+	}
+	if modTime, ok := l[name]; ok {
+		return &listingDir{info: dirInfo{name: name, modTime: modTime}}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// listingDir is an open directory of a listingFS.
+type listingDir struct {
+	info    dirInfo
+	entries []fs.DirEntry
+	read    int
+}
+
+func (d *listingDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *listingDir) Close() error               { return nil }
+
+func (d *listingDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *listingDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.read:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.read += len(rest)
+	return rest, nil
+}
+
+// dirInfo describes a directory of a listingFS, both as an fs.FileInfo
+// and as an fs.DirEntry.
+type dirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i dirInfo) Name() string               { return i.name }
+func (i dirInfo) Size() int64                { return 0 }
+func (i dirInfo) Mode() fs.FileMode          { return fs.ModeDir | 0o755 }
+func (i dirInfo) ModTime() time.Time         { return i.modTime }
+func (i dirInfo) IsDir() bool                { return true }
+func (i dirInfo) Sys() any                   { return nil }
+func (i dirInfo) Type() fs.FileMode          { return fs.ModeDir }
+func (i dirInfo) Info() (fs.FileInfo, error) { return i, nil }
@@ -0,0 +1,115 @@
+package mount
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iupload/fileserver"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ServeMkdir creates the directory named by the "dir" parameter,
+// along with any missing parents, in mounts that allow managing
+// files.
+func (ms *Mounts) ServeMkdir(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+	dir := r.Form.Get("dir")
+	if dir == "" {
+		return fileserver.Error(http.StatusBadRequest, errors.New("no directory given"))
+	}
+	m, rest, err := ms.Lookup(dir)
+	if err != nil {
+		return err
+	}
+	if err := m.manageable(r); err != nil {
+		return err
+	}
+	if m.Files.IsHidden(rest) {
+		return fileserver.Error(http.StatusForbidden, fmt.Errorf("%s is reserved", dir))
+	}
+	created, err := m.Upload.Mkdir(rest)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, map[string]any{"path": created})
+}
+
+// ServeRemove removes the files named by the "file" parameters,
+// relative to "dir", as ServeDownload takes them, in mounts that
+// allow managing files. Directories must be empty unless the
+// "recursive" parameter is set. Nothing can be removed from drop
+// boxes, whose files belong to whoever left them.
+//
+// Every file is checked before any is removed, so that a bad name
+// leaves everything in place. Should removing one fail all the same,
+// the response lists those removed before it next to the error.
+func (ms *Mounts) ServeRemove(w http.ResponseWriter, r *http.Request) error {
+	m, err := ms.formMount(r)
+	if err != nil {
+		return err
+	}
+	if err := m.manageable(r); err != nil {
+		return err
+	}
+	if m.Files.DropBox {
+		return fileserver.Error(http.StatusForbidden, errors.New("files cannot be removed from a drop box"))
+	}
+	files := r.Form["file"]
+	if len(files) == 0 {
+		return fileserver.Error(http.StatusBadRequest, errors.New("no file given"))
+	}
+	recursive, _ := strconv.ParseBool(r.Form.Get("recursive"))
+	dir := r.Form.Get("dir")
+	names := make([]string, len(files))
+	for i, file := range files {
+		// names may be given from the root, like ServeDownload takes them
+		if names[i] = strings.TrimPrefix(path.Join("/", dir, file), "/"); names[i] == "" {
+			names[i] = "."
+		}
+		if _, err := m.Upload.CheckRemove(names[i], recursive, m.Files.IsHidden); err != nil {
+			return err
+		}
+	}
+	removed := []string{}
+	for _, name := range names {
+		if err := m.Upload.Remove(name, recursive, m.Files.IsHidden); err != nil {
+			status, message := http.StatusInternalServerError, err.Error()
+			var he fileserver.HandlerError
+			if errors.As(err, &he) && he.Err != nil {
+				status, message = he.StatusCode, he.Err.Error()
+			}
+			writeJSON(w, status, map[string]any{"removed": removed, "error": message})
+			return err
+		}
+		removed = append(removed, strings.TrimPrefix(path.Join(m.Path, name), "/"))
+	}
+	return writeJSON(w, http.StatusOK, map[string]any{"removed": removed})
+}
+
+// manageable refuses r unless directories can be created and files
+// removed in m, by the user making it: one who may both see the files
+// and upload them.
+func (m *Mount) manageable(r *http.Request) error {
+	if m.Upload == nil {
+		return fileserver.Error(http.StatusForbidden, fmt.Errorf("%s is read-only", "/"+m.Path))
+	}
+	if !m.Upload.Manage {
+		return fileserver.Error(http.StatusForbidden, fmt.Errorf("files in %s cannot be managed", "/"+m.Path))
+	}
+	if err := m.Files.Authorize(r); err != nil {
+		return err
+	}
+	return m.Upload.Authorize(r)
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,105 @@
+package mount
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"iupload/auth"
+	"iupload/fileserver"
+	"iupload/upload"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// statusOf returns the status code that err would be answered with.
+func statusOf(err error) int {
+	var he fileserver.HandlerError
+	if errors.As(err, &he) {
+		return he.StatusCode
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// post sends form to handler h as the user holding a client
+// certificate with the given common name, or anonymously for "", and
+// returns the status code it is answered with.
+func post(h func(http.ResponseWriter, *http.Request) error, target string, form url.Values, user string) int {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: user}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		r = auth.Identify(r, auth.FieldCommonName)
+	}
+	w := httptest.NewRecorder()
+	if err := h(w, r); err != nil {
+		return statusOf(err)
+	}
+	return w.Code
+}
+
+func TestManageGates(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Mount{
+		Files:  &fileserver.FileServer{Root: root, Users: []string{"alice", "bob"}},
+		Upload: &upload.Upload{Root: root, Users: []string{"alice", "carol"}},
+	}
+	ms, err := New([]*Mount{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir := url.Values{"dir": {"new"}}
+	remove := url.Values{"file": {"a.txt"}}
+
+	// off unless asked for
+	if status := post(ms.ServeMkdir, "/_mkdir", mkdir, "alice"); status != http.StatusForbidden {
+		t.Errorf("mkdir without manage: status %d, want %d", status, http.StatusForbidden)
+	}
+	if status := post(ms.ServeRemove, "/_rm", remove, "alice"); status != http.StatusForbidden {
+		t.Errorf("rm without manage: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	// only for users who may both see the files and upload them
+	m.Upload.Manage = true
+	for _, user := range []string{"", "bob", "carol"} {
+		if status := post(ms.ServeMkdir, "/_mkdir", mkdir, user); status != http.StatusForbidden {
+			t.Errorf("mkdir by %q: status %d, want %d", user, status, http.StatusForbidden)
+		}
+		if status := post(ms.ServeRemove, "/_rm", remove, user); status != http.StatusForbidden {
+			t.Errorf("rm by %q: status %d, want %d", user, status, http.StatusForbidden)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "new")); err == nil {
+		t.Fatal("directory created by a refused request")
+	}
+	if status := post(ms.ServeMkdir, "/_mkdir", mkdir, "alice"); status != http.StatusCreated {
+		t.Errorf("mkdir by alice: status %d, want %d", status, http.StatusCreated)
+	}
+	if status := post(ms.ServeRemove, "/_rm", remove, "alice"); status != http.StatusOK {
+		t.Errorf("rm by alice: status %d, want %d", status, http.StatusOK)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt still there after rm: %v", err)
+	}
+
+	// nothing leaves a drop box
+	m.Files.DropBox = true
+	if err := os.WriteFile(filepath.Join(root, "b.txt"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if status := post(ms.ServeRemove, "/_rm", url.Values{"file": {"b.txt"}}, "alice"); status != http.StatusForbidden {
+		t.Errorf("rm from a drop box: status %d, want %d", status, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,283 @@
+// Package mount serves several directories under paths of their
+// own, each with its own file server and upload settings.
+package mount
+
+import (
+	"errors"
+	"fmt"
+	"iupload/fileserver"
+	"iupload/upload"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Mount is a directory served under a path of its own.
+type Mount struct {
+	// The path the mount appears under, such as "builds". A mount
+	// with an empty path is served at the top level, and must be
+	// the only one.
+	Path string
+
+	// Serves the files of the mount.
+	Files *fileserver.FileServer
+
+	// Accepts uploads into the mount. If nil, the mount is read-only.
+	Upload *upload.Upload
+
+	// What clients may do with the mount: ModeReadWrite, ModeReadOnly
+	// or ModeDropBox. Default: ModeReadWrite
+	Mode string
+}
+
+// Modes of mounts.
+const (
+	// Files can be browsed, downloaded and uploaded.
+	ModeReadWrite = "read-write"
+
+	// Files can be browsed and downloaded, but not uploaded.
+	ModeReadOnly = "read-only"
+
+	// Files can be uploaded, but not listed or downloaded.
+	ModeDropBox = "drop-box"
+)
+
+// CheckMode returns an error if mode is not one of the modes of
+// mounts.
+func CheckMode(mode string) error {
+	switch mode {
+	case "", ModeReadWrite, ModeReadOnly, ModeDropBox:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// Mounts dispatches requests to the mount they concern. Paths in
+// requests, such as the "dir" and "file" parameters of uploads and
+// downloads, start with the path of the mount.
+type Mounts struct {
+	mounts []*Mount
+
+	// lists the mounts at the top level, if there is more than one
+	listing *fileserver.FileServer
+}
+
+// New sets up the given mounts, telling their file servers and
+// uploads the paths they are served under.
+func New(mounts []*Mount) (*Mounts, error) {
+	if len(mounts) == 0 {
+		return nil, errors.New("nothing to serve")
+	}
+	ms := &Mounts{mounts: mounts}
+	for _, m := range mounts {
+		if m.Path == "" && len(mounts) > 1 {
+			return nil, errors.New("a mount at the top level must be the only one")
+		}
+		if m.Path != "" {
+			m.Files.Prefix = "/" + m.Path
+		}
+		if err := CheckMode(m.Mode); err != nil {
+			return nil, err
+		}
+		switch m.Mode {
+		case ModeReadOnly:
+			m.Upload = nil
+		case ModeDropBox:
+			if m.Upload == nil {
+				return nil, fmt.Errorf("%s: a drop box needs upload settings", "/"+m.Path)
+			}
+			m.Files.DropBox = true
+			if m.Files.Browse == nil {
+				// the upload form is on the listing page
+				m.Files.Browse = &fileserver.Browse{}
+			}
+		}
+		m.Files.UploadForm = m.Upload != nil
+		m.Files.SelectionForm = true
+		if m.Upload != nil {
+			m.Upload.Prefix = m.Path
+			m.Files.UploadUsers = m.Upload.Users
+		}
+	}
+	if mounts[0].Path != "" {
+		ms.listing = newListing(mounts)
+	}
+	return ms, nil
+}
+
+// newListing returns a file server listing the mounts as if they
+// were directories.
+func newListing(mounts []*Mount) *fileserver.FileServer {
+	dirs := make(listingFS)
+	for _, m := range mounts {
+		var modTime time.Time
+		if info, err := os.Stat(m.Files.Root); err == nil {
+			modTime = info.ModTime()
+		}
+		dirs[m.Path] = modTime
+	}
+	return &fileserver.FileServer{
+		FS:       dirs,
+		Browse:   &fileserver.Browse{},
+		Compress: true,
+	}
+}
+
+// Lookup returns the mount that the path p is in, and p relative to
+// the mount.
+func (ms *Mounts) Lookup(p string) (*Mount, string, error) {
+	if ms.mounts[0].Path == "" {
+		return ms.mounts[0], p, nil
+	}
+	clean := path.Clean("/" + p)
+	for _, m := range ms.mounts {
+		if rest, ok := strings.CutPrefix(clean, "/"+m.Path); ok && (rest == "" || rest[0] == '/') {
+			return m, strings.TrimPrefix(rest, "/"), nil
+		}
+	}
+	return nil, "", fileserver.Error(http.StatusNotFound, fmt.Errorf("nothing is mounted at %s", clean))
+}
+
+// Resolve returns the file server for the path p, and p relative
+// to its root.
+func (ms *Mounts) Resolve(p string) (*fileserver.FileServer, string, error) {
+	m, rest, err := ms.Lookup(p)
+	if err != nil {
+		return nil, "", err
+	}
+	return m.Files, rest, nil
+}
+
+// ServeHTTP serves files and directory listings, and the list of
+// mounts at the top level.
+func (ms *Mounts) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	if ms.listing != nil && r.URL.Path == "/" {
+		return ms.listing.ServeHTTP(w, r)
+	}
+	m, _, err := ms.Lookup(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	return m.Files.ServeHTTP(w, r)
+}
+
+// ServeDownload serves downloads from the mount named by the "dir"
+// parameter or, without it, the one all "file" parameters are in.
+func (ms *Mounts) ServeDownload(w http.ResponseWriter, r *http.Request) error {
+	m, err := ms.formMount(r)
+	if err != nil {
+		return err
+	}
+	return m.Files.ServeDownload(w, r)
+}
+
+// ServeSign mints signed download links for files of any mount.
+func (ms *Mounts) ServeSign(w http.ResponseWriter, r *http.Request) error {
+	m, err := ms.formMount(r)
+	if err != nil {
+		return err
+	}
+	return m.Files.ServeSign(w, r)
+}
+
+// formMount finds the mount that the "dir" and "file" parameters of
+// r refer to, and rewrites them to be relative to it.
+func (ms *Mounts) formMount(r *http.Request) (*Mount, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, fileserver.Error(http.StatusBadRequest, err)
+	}
+	if ms.listing == nil {
+		return ms.mounts[0], nil
+	}
+	if dir := r.Form.Get("dir"); dir != "" {
+		m, rest, err := ms.Lookup(dir)
+		if err != nil {
+			return nil, err
+		}
+		r.Form.Set("dir", rest)
+		return m, nil
+	}
+	var mount *Mount
+	files := r.Form["file"]
+	for i, file := range files {
+		m, rest, err := ms.Lookup(file)
+		if err != nil {
+			return nil, err
+		}
+		if mount != nil && m != mount {
+			return nil, fileserver.Error(http.StatusBadRequest, errors.New("files must be from the same mount"))
+		}
+		mount = m
+		if files[i] = rest; rest == "" {
+			files[i] = "."
+		}
+	}
+	if mount == nil {
+		return nil, fileserver.Error(http.StatusBadRequest, fmt.Errorf("no file given"))
+	}
+	return mount, nil
+}
+
+// ServeMultipart accepts form posts into the mount named by the
+// "dir" query parameter.
+func (ms *Mounts) ServeMultipart(w http.ResponseWriter, r *http.Request) error {
+	m, err := ms.uploadMount(r, r.URL.Query().Get("dir"))
+	if err != nil {
+		return err
+	}
+	return m.Upload.ServeMultipart(w, r)
+}
+
+// ServeTus handles tus requests. Uploads are created in the mount
+// named by their target directory, and later requests go to the
+// mount holding the upload.
+func (ms *Mounts) ServeTus(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodOptions:
+		for _, m := range ms.mounts {
+			if m.Upload != nil {
+				return m.Upload.ServeTus(w, r)
+			}
+		}
+		return fileserver.Error(http.StatusForbidden, errors.New("uploads are not allowed"))
+
+	case http.MethodPost:
+		dir, err := upload.TusDir(r)
+		if err != nil {
+			return fileserver.Error(http.StatusBadRequest, err)
+		}
+		m, err := ms.uploadMount(r, dir)
+		if err != nil {
+			return err
+		}
+		return m.Upload.ServeTus(w, r)
+	}
+
+	id := path.Base(r.URL.Path)
+	for _, m := range ms.mounts {
+		if m.Upload != nil && m.Upload.HasTus(id) {
+			return m.Upload.ServeTus(w, r)
+		}
+	}
+	return fileserver.Error(http.StatusNotFound, fmt.Errorf("unknown upload %q", id))
+}
+
+// uploadMount finds the mount that the upload directory dir is in,
+// and makes the "dir" query parameter of r relative to it.
+func (ms *Mounts) uploadMount(r *http.Request, dir string) (*Mount, error) {
+	m, rest, err := ms.Lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m.Upload == nil {
+		return nil, fileserver.Error(http.StatusForbidden, fmt.Errorf("%s is read-only", "/"+m.Path))
+	}
+	if ms.listing != nil {
+		query := r.URL.Query()
+		query.Set("dir", rest)
+		r.URL.RawQuery = query.Encode()
+	}
+	return m, nil
+}
@@ -0,0 +1,271 @@
+package share
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iupload/auth"
+	"iupload/fileserver"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errAnonymous is returned for attempts to manage shares without
+// being identified, since shares are managed by the user who made
+// them.
+var errAnonymous = errors.New("a client certificate is required to manage shares")
+
+// errSignedOnly is returned for shares of files that may only be
+// downloaded through signed links.
+var errSignedOnly = errors.New("these files are only handed out through signed links")
+
+// Handler serves shares below Prefix, such as "/s", and manages
+// them.
+type Handler struct {
+	Store *Store
+
+	// Returns the file server holding the file at a path, and the
+	// path relative to its root.
+	Resolve func(name string) (*fileserver.FileServer, string, error)
+
+	Prefix string
+
+	// The users who may list and revoke shares made by others.
+	Admins []string
+}
+
+// ServeCreate creates a share of the file or directory named by the
+// "path" parameter, relative to the root. The optional parameters
+// "password", "max_downloads" and "ttl" (a duration such as "72h")
+// restrict access to it. Files of file servers with SignedOnly set
+// cannot be shared, as shares would bypass the signed links.
+func (h *Handler) ServeCreate(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+	name := r.Form.Get("path")
+	files, rel, err := h.Resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := files.Authorize(r); err != nil {
+		return err
+	}
+	if files.DropBox {
+		return fileserver.Error(http.StatusForbidden, fileserver.ErrDropBox)
+	}
+	if files.SignedOnly {
+		return fileserver.Error(http.StatusForbidden, errSignedOnly)
+	}
+	if strings.Contains(name, "..") || files.IsHidden(rel) {
+		return fileserver.Error(http.StatusBadRequest, fmt.Errorf("Invalid filename. Please check and try again."))
+	}
+	name = path.Clean("/" + name)[1:]
+	info, err := os.Stat(fileserver.SanitizedPathJoin(files.Root, rel))
+	if err != nil {
+		return fileserver.Error(http.StatusNotFound, fmt.Errorf("file not found"))
+	}
+
+	sh := &Share{Path: name, Dir: info.IsDir(), Creator: auth.User(r)}
+	if v := r.Form.Get("max_downloads"); v != "" {
+		if sh.MaxDownloads, err = strconv.Atoi(v); err != nil || sh.MaxDownloads < 0 {
+			return fileserver.Error(http.StatusBadRequest, fmt.Errorf("invalid max_downloads %q", v))
+		}
+	}
+	if v := r.Form.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return fileserver.Error(http.StatusBadRequest, fmt.Errorf("invalid ttl %q", v))
+		}
+		expires := time.Now().Add(ttl).UTC()
+		sh.Expires = &expires
+	}
+	if password := r.Form.Get("password"); password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fileserver.Error(http.StatusBadRequest, err)
+		}
+		sh.PasswordHash, sh.Protected = string(hash), true
+	}
+	if err := h.Store.Create(sh); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusCreated, h.view(r, *sh))
+}
+
+// ServeList lists the active shares that the client may manage.
+func (h *Handler) ServeList(w http.ResponseWriter, r *http.Request) error {
+	if auth.User(r) == "" {
+		return fileserver.Error(http.StatusForbidden, errAnonymous)
+	}
+	views := []map[string]any{}
+	for _, sh := range h.Store.List() {
+		if h.manage(r, sh) == nil {
+			views = append(views, h.view(r, sh))
+		}
+	}
+	return writeJSON(w, http.StatusOK, views)
+}
+
+// ServeRevoke revokes the share whose ID is the last element of
+// the request path, if the client may manage it.
+func (h *Handler) ServeRevoke(w http.ResponseWriter, r *http.Request) error {
+	if auth.User(r) == "" {
+		return fileserver.Error(http.StatusForbidden, errAnonymous)
+	}
+	id := path.Base(r.URL.Path)
+	sh, ok := h.Store.Get(id)
+	if !ok {
+		return fileserver.Error(http.StatusNotFound, errors.New("no such share"))
+	}
+	if err := h.manage(r, sh); err != nil {
+		return err
+	}
+	ok, err := h.Store.Revoke(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fileserver.Error(http.StatusNotFound, errors.New("no such share"))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ServeShare serves a shared file, or a directory listing or file
+// within a shared directory. The password of a protected share is
+// taken from basic authentication or the "password" parameter.
+// Every download of a file counts towards the limit of the share;
+// listings and requests resuming a download do not.
+func (h *Handler) ServeShare(w http.ResponseWriter, r *http.Request) error {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, h.Prefix+"/"), "/")
+	sh, ok := h.Store.Get(id)
+	if !ok {
+		return fileserver.Error(http.StatusNotFound, errors.New("no such share"))
+	}
+	if !sh.Active(time.Now()) {
+		return fileserver.Error(http.StatusGone, ErrInactive)
+	}
+	if sh.Protected && !checkPassword(r, sh.PasswordHash) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="share", charset="UTF-8"`)
+		return fileserver.Error(http.StatusUnauthorized, errors.New("password required"))
+	}
+
+	mounted, rel, err := h.Resolve(sh.Path)
+	if err != nil {
+		return err
+	}
+	if mounted.DropBox {
+		return fileserver.Error(http.StatusForbidden, fileserver.ErrDropBox)
+	}
+	if mounted.SignedOnly {
+		// signed_only may have been turned on after the share was made
+		return fileserver.Error(http.StatusForbidden, errSignedOnly)
+	}
+	files := *mounted
+	files.Root = fileserver.SanitizedPathJoin(mounted.Root, rel)
+	files.Prefix = h.Prefix + "/" + id
+	files.UploadForm, files.SelectionForm = false, false
+	// holding the link is what grants access
+	files.Users = nil
+	name := rest
+	if !sh.Dir {
+		if rest != "" {
+			return fileserver.Error(http.StatusNotFound, os.ErrNotExist)
+		}
+		files.Root = filepath.Dir(files.Root)
+		name = path.Base("/" + sh.Path)
+	}
+
+	if r.Method == http.MethodGet && countsAsDownload(r) {
+		info, err := os.Stat(fileserver.SanitizedPathJoin(files.Root, name))
+		if err == nil && info.Mode().IsRegular() && !files.IsHidden(name) {
+			if err := h.Store.Use(id); err != nil {
+				return fileserver.Error(http.StatusGone, err)
+			}
+		}
+	}
+	if !sh.Dir {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		return files.ServeFile(w, r, name)
+	}
+	return files.ServeHTTP(w, r)
+}
+
+// manage refuses r unless the client may manage sh: one of Admins,
+// or the user who made it, as long as they may still access the
+// files of the mount it shares from.
+func (h *Handler) manage(r *http.Request, sh Share) error {
+	user := auth.User(r)
+	if user != "" && slices.Contains(h.Admins, user) {
+		return nil
+	}
+	if user == "" || user != sh.Creator {
+		return fileserver.Error(http.StatusForbidden, errors.New("only the user who made a share may manage it"))
+	}
+	files, _, err := h.Resolve(sh.Path)
+	if err != nil {
+		return err
+	}
+	return files.Authorize(r)
+}
+
+// view returns what clients get to see of sh.
+func (h *Handler) view(r *http.Request, sh Share) map[string]any {
+	link := h.Prefix + "/" + sh.ID
+	if sh.Dir {
+		link += "/"
+	}
+	view := map[string]any{
+		"id":        sh.ID,
+		"path":      sh.Path,
+		"dir":       sh.Dir,
+		"protected": sh.Protected,
+		"downloads": sh.Downloads,
+		"created":   sh.Created,
+		"url":       fileserver.AbsoluteURL(r, link),
+	}
+	if sh.Creator != "" {
+		view["creator"] = sh.Creator
+	}
+	if sh.MaxDownloads > 0 {
+		view["max_downloads"] = sh.MaxDownloads
+	}
+	if sh.Expires != nil {
+		view["expires"] = sh.Expires
+	}
+	return view
+}
+
+// checkPassword reports whether the request carries the password
+// matching hash.
+func checkPassword(r *http.Request, hash string) bool {
+	password := r.URL.Query().Get("password")
+	if _, p, ok := r.BasicAuth(); ok {
+		password = p
+	}
+	return password != "" && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// countsAsDownload reports whether r starts a download rather than
+// resuming one.
+func countsAsDownload(r *http.Request) bool {
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,151 @@
+package share
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"iupload/auth"
+	"iupload/fileserver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// statusOf returns the status code that err would be answered with.
+func statusOf(err error) int {
+	var he fileserver.HandlerError
+	if errors.As(err, &he) {
+		return he.StatusCode
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// newTestHandler returns a Handler sharing files from a fresh root
+// holding a.txt, served by files.
+func newTestHandler(t *testing.T, files *fileserver.FileServer) *Handler {
+	t.Helper()
+	files.Root = t.TempDir()
+	if err := os.WriteFile(filepath.Join(files.Root, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(filepath.Join(t.TempDir(), "shares.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{
+		Store: store,
+		Resolve: func(name string) (*fileserver.FileServer, string, error) {
+			return files, name, nil
+		},
+		Prefix: "/s",
+	}
+}
+
+// serve sends a request to handler h and returns the status code it
+// is answered with.
+func serve(h func(http.ResponseWriter, *http.Request) error, r *http.Request) int {
+	w := httptest.NewRecorder()
+	if err := h(w, r); err != nil {
+		return statusOf(err)
+	}
+	return w.Code
+}
+
+func TestSignedOnlyShares(t *testing.T) {
+	files := &fileserver.FileServer{}
+	h := newTestHandler(t, files)
+	sh := &Share{Path: "a.txt"}
+	if err := h.Store.Create(sh); err != nil {
+		t.Fatal(err)
+	}
+	if status := serve(h.ServeShare, httptest.NewRequest(http.MethodGet, "/s/"+sh.ID, nil)); status != http.StatusOK {
+		t.Fatalf("share: status %d, want %d", status, http.StatusOK)
+	}
+
+	files.SignedOnly = true
+	if status := serve(h.ServeShare, httptest.NewRequest(http.MethodGet, "/s/"+sh.ID, nil)); status != http.StatusForbidden {
+		t.Errorf("share of signed-only files: status %d, want %d", status, http.StatusForbidden)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/_shares?path=a.txt", nil)
+	if status := serve(h.ServeCreate, r); status != http.StatusForbidden {
+		t.Errorf("sharing signed-only files: status %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+// asUser returns r made by the user holding a client certificate
+// with the given common name, or r itself for "".
+func asUser(r *http.Request, user string) *http.Request {
+	if user == "" {
+		return r
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: user}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return auth.Identify(r, auth.FieldCommonName)
+}
+
+func TestManageShares(t *testing.T) {
+	h := newTestHandler(t, &fileserver.FileServer{})
+	h.Admins = []string{"root"}
+
+	create := asUser(httptest.NewRequest(http.MethodPost, "/_shares?path=a.txt", nil), "alice")
+	w := httptest.NewRecorder()
+	if err := h.ServeCreate(w, create); err != nil {
+		t.Fatal(err)
+	}
+	var created struct{ ID string }
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		user  string
+		count int
+	}{
+		{"alice", 1},
+		{"bob", 0},
+		{"root", 1},
+	} {
+		w := httptest.NewRecorder()
+		if err := h.ServeList(w, asUser(httptest.NewRequest(http.MethodGet, "/_shares", nil), tt.user)); err != nil {
+			t.Fatalf("%s: %v", tt.user, err)
+		}
+		var list []map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != tt.count {
+			t.Errorf("%s sees %d shares, want %d", tt.user, len(list), tt.count)
+		}
+	}
+	if status := serve(h.ServeList, httptest.NewRequest(http.MethodGet, "/_shares", nil)); status != http.StatusForbidden {
+		t.Errorf("anonymous list: status %d, want %d", status, http.StatusForbidden)
+	}
+
+	revoke := func(user string) int {
+		return serve(h.ServeRevoke, asUser(httptest.NewRequest(http.MethodDelete, "/_shares/"+created.ID, nil), user))
+	}
+	for _, user := range []string{"", "bob"} {
+		if status := revoke(user); status != http.StatusForbidden {
+			t.Errorf("revoke by %q: status %d, want %d", user, status, http.StatusForbidden)
+		}
+	}
+	if status := revoke("alice"); status != http.StatusNoContent {
+		t.Errorf("revoke by the creator: status %d, want %d", status, http.StatusNoContent)
+	}
+
+	sh := &Share{Path: "a.txt", Creator: "alice"}
+	if err := h.Store.Create(sh); err != nil {
+		t.Fatal(err)
+	}
+	created.ID = sh.ID
+	if status := revoke("root"); status != http.StatusNoContent {
+		t.Errorf("revoke by an admin: status %d, want %d", status, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,205 @@
+// Package share manages links that give others access to a single
+// file or directory, optionally protected by a password and limited
+// in time and number of downloads.
+package share
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Share is a link to a file or directory below the root.
+type Share struct {
+	// The random identifier the share is reached by.
+	ID string `json:"id"`
+
+	// The shared file or directory, relative to the root.
+	Path string `json:"path"`
+
+	// Whether Path is a directory.
+	Dir bool `json:"dir"`
+
+	// The user who made the share, as identified by their client
+	// certificate, if any.
+	Creator string `json:"creator,omitempty"`
+
+	// The bcrypt hash of the password, if the share has one.
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	// Whether the share is protected by a password.
+	Protected bool `json:"protected"`
+
+	// How often files of the share may be downloaded. Zero means
+	// no limit.
+	MaxDownloads int `json:"max_downloads,omitempty"`
+
+	// How often files of the share have been downloaded.
+	Downloads int `json:"downloads"`
+
+	// When the share stops working, if ever.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	Created time.Time `json:"created"`
+}
+
+// Active reports whether s can still be used at the time now.
+func (s *Share) Active(now time.Time) bool {
+	if s.Expires != nil && now.After(*s.Expires) {
+		return false
+	}
+	return s.MaxDownloads == 0 || s.Downloads < s.MaxDownloads
+}
+
+// ErrInactive is returned for shares that have expired or reached
+// their download limit.
+var ErrInactive = errors.New("share is no longer available")
+
+// Store keeps shares in a JSON file, which is rewritten on every
+// change. Shares that are no longer active are dropped from it when
+// it is opened.
+type Store struct {
+	file   string
+	mu     sync.Mutex
+	shares map[string]*Share
+}
+
+// Open loads the store kept in file, which need not exist yet.
+func Open(file string) (*Store, error) {
+	s := &Store{file: file, shares: make(map[string]*Share)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shares []*Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, sh := range shares {
+		if sh.Active(now) {
+			s.shares[sh.ID] = sh
+		}
+	}
+	return s, nil
+}
+
+// Create assigns sh a new ID and adds it to the store.
+func (s *Store) Create(sh *Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		if _, taken := s.shares[id]; !taken {
+			sh.ID = id
+			break
+		}
+	}
+	sh.Created = time.Now().UTC()
+	s.shares[sh.ID] = sh
+	return s.save()
+}
+
+// Get returns a copy of the share with the given ID.
+func (s *Store) Get(id string) (Share, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok {
+		return Share{}, false
+	}
+	return *sh, true
+}
+
+// List returns the active shares, the oldest first.
+func (s *Store) List() []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var shares []Share
+	for _, sh := range s.shares {
+		if sh.Active(now) {
+			shares = append(shares, *sh)
+		}
+	}
+	slices.SortFunc(shares, func(a, b Share) int {
+		return a.Created.Compare(b.Created)
+	})
+	return shares
+}
+
+// Revoke removes the share with the given ID. It reports whether
+// there was such a share.
+func (s *Store) Revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.shares[id]; !ok {
+		return false, nil
+	}
+	delete(s.shares, id)
+	return true, s.save()
+}
+
+// Use counts a download from the share with the given ID, unless
+// the share is no longer active, in which case it returns ErrInactive.
+func (s *Store) Use(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok || !sh.Active(time.Now()) {
+		return ErrInactive
+	}
+	sh.Downloads++
+	return s.save()
+}
+
+// save writes the shares to the file. It must be called with s.mu
+// held.
+func (s *Store) save() error {
+	shares := make([]*Share, 0, len(s.shares))
+	for _, sh := range s.shares {
+		shares = append(shares, sh)
+	}
+	data, err := json.MarshalIndent(shares, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.file), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.file), filepath.Base(s.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file)
+}
+
+// newID returns a short random identifier for a share.
+func newID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,71 @@
+package share
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "shares.json")
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := &Share{Path: "a.txt", MaxDownloads: 2}
+	expired := time.Now().Add(-time.Minute)
+	gone := &Share{Path: "b.txt", Expires: &expired}
+	dir := &Share{Path: "builds", Dir: true, Creator: "alice"}
+	for _, sh := range []*Share{limited, gone, dir} {
+		if err := s.Create(sh); err != nil {
+			t.Fatal(err)
+		}
+		if sh.ID == "" || sh.Created.IsZero() {
+			t.Fatalf("share of %s has no ID or creation time", sh.Path)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Use(limited.ID); err != nil {
+			t.Fatalf("download %d: %v", i+1, err)
+		}
+	}
+	if err := s.Use(limited.ID); !errors.Is(err, ErrInactive) {
+		t.Errorf("download beyond the limit: %v, want %v", err, ErrInactive)
+	}
+	if err := s.Use(gone.ID); !errors.Is(err, ErrInactive) {
+		t.Errorf("download of an expired share: %v, want %v", err, ErrInactive)
+	}
+	if list := s.List(); len(list) != 1 || list[0].ID != dir.ID {
+		t.Errorf("List() = %v, want only the share of %s", list, dir.Path)
+	}
+
+	// inactive shares are dropped when the store is opened again
+	s, err = Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range []*Share{limited, gone} {
+		if _, ok := s.Get(sh.ID); ok {
+			t.Errorf("inactive share of %s was kept", sh.Path)
+		}
+	}
+	got, ok := s.Get(dir.ID)
+	if !ok || got.Path != "builds" || !got.Dir || got.Creator != "alice" {
+		t.Fatalf("Get(%s) = %+v, %v", dir.ID, got, ok)
+	}
+
+	if ok, err := s.Revoke(dir.ID); !ok || err != nil {
+		t.Fatalf("Revoke: %v, %v", ok, err)
+	}
+	if ok, _ := s.Revoke(dir.ID); ok {
+		t.Error("revoked a share twice")
+	}
+	if s, err = Open(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(dir.ID); ok {
+		t.Error("revoked share is back after opening the store again")
+	}
+}
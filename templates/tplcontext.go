@@ -325,7 +325,7 @@ func (c TemplateContext) funcHTTPError(statusCode int) (bool, error) {
 	c.RespHeader.Header.Del("Last-Modified")
 	c.RespHeader.Header.Del("Accept-Ranges")
 
-	return false, errors.New(string(statusCode))
+	return false, errors.New(strconv.Itoa(statusCode))
 }
 
 // funcHumanize transforms size and time inputs to a human readable format.
@@ -0,0 +1,239 @@
+// Package throttle limits the bandwidth used by responses and
+// request bodies with token buckets, both across all connections
+// and per connection.
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits are bandwidth limits in bytes per second. Zero means no
+// limit.
+type Limits struct {
+	// The bandwidth shared by all connections.
+	Rate int64 `json:"rate,omitempty"`
+
+	// The bandwidth of a single connection.
+	PerConnection int64 `json:"per_connection,omitempty"`
+}
+
+// maxBurst caps how many bytes go out at once, so that even
+// generous limits are enforced smoothly.
+const maxBurst = 256 << 10
+
+// Throttle applies separate Limits to anonymous clients and
+// authenticated users. Traffic in each direction has its own
+// buckets, so uploads don't slow down downloads.
+type Throttle struct {
+	Anonymous     Limits `json:"anonymous"`
+	Authenticated Limits `json:"authenticated"`
+
+	// Reports whether a request comes from an authenticated user.
+	// Without it, all clients are anonymous.
+	IsAuthenticated func(r *http.Request) bool `json:"-"`
+
+	once   sync.Once
+	global map[bucketKey]*rate.Limiter
+}
+
+// Validate ensures t has a valid configuration.
+func (t *Throttle) Validate() error {
+	for _, limits := range []Limits{t.Anonymous, t.Authenticated} {
+		if limits.Rate < 0 || limits.PerConnection < 0 {
+			return errors.New("bandwidth limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// bucketKey tells the buckets of a class of clients and a direction
+// of traffic apart.
+type bucketKey struct {
+	authenticated bool
+	upload        bool
+}
+
+// Wrap returns h with its response and request body throttled.
+func (t *Throttle) Wrap(h func(http.ResponseWriter, *http.Request) error) func(http.ResponseWriter, *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if t == nil {
+			return h(w, r)
+		}
+		if down := t.limiters(r, false); len(down) > 0 {
+			w = &responseWriter{ResponseWriter: w, ctx: r.Context(), limiters: down}
+		}
+		if up := t.limiters(r, true); len(up) > 0 && r.Body != nil {
+			r.Body = &body{ReadCloser: r.Body, ctx: r.Context(), limiters: up}
+		}
+		return h(w, r)
+	}
+}
+
+// limiters returns the buckets that traffic of r in the given
+// direction has to pass.
+func (t *Throttle) limiters(r *http.Request, upload bool) []*rate.Limiter {
+	t.init()
+	key := bucketKey{upload: upload}
+	key.authenticated = t.IsAuthenticated != nil && t.IsAuthenticated(r)
+	var limiters []*rate.Limiter
+	if l := t.global[key]; l != nil {
+		limiters = append(limiters, l)
+	}
+	if limit := t.limits(key.authenticated).PerConnection; limit > 0 {
+		limiters = append(limiters, connLimiter(r, key, limit))
+	}
+	return limiters
+}
+
+// init creates the buckets shared by all connections.
+func (t *Throttle) init() {
+	t.once.Do(func() {
+		t.global = make(map[bucketKey]*rate.Limiter)
+		for _, key := range []bucketKey{{false, false}, {false, true}, {true, false}, {true, true}} {
+			if limit := t.limits(key.authenticated).Rate; limit > 0 {
+				t.global[key] = newLimiter(limit)
+			}
+		}
+	})
+}
+
+// CarryOver takes over the buckets shared by all connections from
+// old, which t replaces, so that reloading the configuration does not
+// hand out a fresh allowance. The buckets are set to the rates of t,
+// as are those of open connections once they make their next
+// request. It must be called before t is used.
+func (t *Throttle) CarryOver(old *Throttle) {
+	if old == nil {
+		return
+	}
+	old.init()
+	t.init()
+	for key, l := range t.global {
+		if prev := old.global[key]; prev != nil {
+			prev.SetLimit(l.Limit())
+			prev.SetBurst(l.Burst())
+			t.global[key] = prev
+		}
+	}
+}
+
+func (t *Throttle) limits(authenticated bool) Limits {
+	if authenticated {
+		return t.Authenticated
+	}
+	return t.Anonymous
+}
+
+func newLimiter(limit int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(limit), int(min(limit, maxBurst)))
+}
+
+// connKey is the context key for the buckets of a connection.
+type connKey struct{}
+
+// connBuckets holds the buckets of one connection.
+type connBuckets struct {
+	mu       sync.Mutex
+	limiters map[bucketKey]*rate.Limiter
+}
+
+// ConnContext prepares the context of a new connection to hold its
+// buckets. It is meant for http.Server.ConnContext; without it, the
+// per-connection limits apply to each request on its own.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, &connBuckets{limiters: make(map[bucketKey]*rate.Limiter)})
+}
+
+// connLimiter returns the bucket of the connection of r, set to
+// limit. Buckets of connections that outlive a reload of the
+// configuration take on the new limit with their next request.
+func connLimiter(r *http.Request, key bucketKey, limit int64) *rate.Limiter {
+	buckets, ok := r.Context().Value(connKey{}).(*connBuckets)
+	if !ok {
+		return newLimiter(limit)
+	}
+	buckets.mu.Lock()
+	defer buckets.mu.Unlock()
+	l := buckets.limiters[key]
+	if l == nil {
+		l = newLimiter(limit)
+		buckets.limiters[key] = l
+	} else if l.Limit() != rate.Limit(limit) {
+		l.SetLimit(rate.Limit(limit))
+		l.SetBurst(int(min(limit, maxBurst)))
+	}
+	return l
+}
+
+// wait blocks until n bytes may pass all limiters.
+func wait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, l := range limiters {
+		if err := l.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunk returns how many bytes of p may be sent in one go.
+func chunk(limiters []*rate.Limiter, p []byte) int {
+	n := len(p)
+	for _, l := range limiters {
+		n = min(n, l.Burst())
+	}
+	return n
+}
+
+// responseWriter throttles what is written to the response.
+type responseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := chunk(w.limiters, p)
+		if err := wait(w.ctx, w.limiters, n); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// body throttles reading a request body.
+type body struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return b.ReadCloser.Read(p)
+	}
+	p = p[:chunk(b.limiters, p)]
+	if err := wait(b.ctx, b.limiters, len(p)); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
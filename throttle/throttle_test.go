@@ -0,0 +1,48 @@
+package throttle
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestCarryOver(t *testing.T) {
+	old := &Throttle{Anonymous: Limits{Rate: 1000, PerConnection: 100}}
+	conn := ConnContext(context.Background(), nil)
+	r := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(conn)
+	before := old.limiters(r, false)
+	if len(before) != 2 {
+		t.Fatalf("%d limiters, want the global and the connection's", len(before))
+	}
+
+	next := &Throttle{Anonymous: Limits{Rate: 2000, PerConnection: 200}}
+	next.CarryOver(old)
+	after := next.limiters(r, false)
+	if len(after) != 2 {
+		t.Fatalf("%d limiters after reloading, want 2", len(after))
+	}
+	for i, want := range []rate.Limit{2000, 200} {
+		if after[i] != before[i] {
+			t.Errorf("limiter %d was replaced rather than carried over", i)
+		}
+		if after[i].Limit() != want {
+			t.Errorf("limiter %d: limit %v, want %v", i, after[i].Limit(), want)
+		}
+		if after[i].Burst() != int(want) {
+			t.Errorf("limiter %d: burst %d, want %d", i, after[i].Burst(), int(want))
+		}
+	}
+
+	// limits added on reload get buckets of their own
+	next = &Throttle{Anonymous: Limits{Rate: 2000}, Authenticated: Limits{Rate: 500}}
+	next.CarryOver(old)
+	if next.global[bucketKey{authenticated: true}] == nil {
+		t.Error("no bucket for the authenticated rate added on reload")
+	}
+	if len(next.limiters(r, false)) != 1 {
+		t.Error("the per-connection limit still applies after being removed")
+	}
+}
@@ -0,0 +1,151 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iupload/archive"
+	"iupload/digest"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultExtractMaxEntries = 10000
+	defaultExtractMaxSize    = 10 << 30
+)
+
+// extractRequested reports whether the client asked for uploaded
+// archives to be unpacked, with the "extract" query parameter.
+func extractRequested(r *http.Request) bool {
+	extract, _ := strconv.ParseBool(r.URL.Query().Get("extract"))
+	return extract
+}
+
+// extractFile receives the archive in src and unpacks it into the
+// directory that dst is in, instead of storing the archive itself.
+// It returns the size and digests of the archive and what happened
+// to each of its entries.
+func (u *Upload) extractFile(dst, format, policy string, expect digest.Sums, src io.Reader) (int64, digest.Sums, []Result, error) {
+	tmp, n, sums, err := u.writeTemp(filepath.Dir(dst), expect, src)
+	if err != nil {
+		return n, nil, nil, err
+	}
+	defer partial.Delete(tmp)
+	defer os.Remove(tmp)
+
+	entries, err := u.unpack(tmp, format, u.relPath(filepath.Dir(dst)), policy)
+	return n, sums, entries, err
+}
+
+// unpack extracts the archive file called name into dir, relative
+// to Root. Every entry goes through the same checks as uploaded
+// files, so entries trying to escape dir are refused; links and
+// special files are skipped. Files are first written to temporary
+// files and only moved into place once the whole archive has been
+// read, so an archive that is corrupt or exceeds the entry count or
+// total size limits leaves existing files untouched.
+func (u *Upload) unpack(name, format, dir, policy string) ([]Result, error) {
+	maxEntries := u.ExtractMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultExtractMaxEntries
+	}
+	budget := &budgetReader{left: u.ExtractMaxSize}
+	if budget.left <= 0 {
+		budget.left = defaultExtractMaxSize
+	}
+
+	// staged files, by index into results
+	type stagedFile struct {
+		tmp, dst string
+		sums     digest.Sums
+	}
+	var results []Result
+	staged := map[int]stagedFile{}
+	err := archive.Walk(name, format, func(hdr archive.Header, r io.Reader) error {
+		if len(results) == maxEntries {
+			return fileserver.Error(http.StatusRequestEntityTooLarge,
+				fmt.Errorf("archive has more than %d entries", maxEntries))
+		}
+		res := Result{Name: hdr.Name}
+		var err error
+		switch {
+		case hdr.Mode.IsDir():
+			var rel, target string
+			if rel, err = cleanRelName(hdr.Name); err == nil {
+				if target, err = u.resolveDir(path.Join(dir, rel)); err == nil {
+					res.Path = u.reportPath(target)
+				}
+			}
+		case hdr.Mode.IsRegular():
+			var dst, tmp string
+			var sums digest.Sums
+			if dst, err = u.resolveFile(dir, hdr.Name); err == nil {
+				budget.r = r
+				tmp, res.Size, sums, err = u.writeTemp(filepath.Dir(dst), nil, budget)
+			}
+			if err == nil {
+				staged[len(results)] = stagedFile{tmp, dst, sums}
+			}
+		default:
+			err = errors.New("not extracted: links and special files are not supported")
+		}
+		if err != nil {
+			res.Error, res.status = errorStatus(err)
+			if res.status == http.StatusRequestEntityTooLarge || res.status == http.StatusInsufficientStorage {
+				return err
+			}
+		}
+		results = append(results, res)
+		return nil
+	})
+	if err != nil {
+		// don't leave half of an archive bomb behind
+		for _, f := range staged {
+			os.Remove(f.tmp)
+			partial.Delete(f.tmp)
+		}
+		return results, fileserver.Error(http.StatusBadRequest, fmt.Errorf("extracting archive: %w", err))
+	}
+
+	// in archive order, so that later entries of the same name win
+	for i := range results {
+		f, ok := staged[i]
+		if !ok {
+			continue
+		}
+		dst, err := u.place(f.tmp, f.dst, policy)
+		partial.Delete(f.tmp)
+		if err != nil {
+			os.Remove(f.tmp)
+			results[i].Error, results[i].status = errorStatus(err)
+			continue
+		}
+		if u.Digests != nil {
+			u.Digests.Put(dst, f.sums)
+		}
+		results[i].Path = u.reportPath(dst)
+		results[i].Digests = f.sums.Hex()
+	}
+	return results, nil
+}
+
+// budgetReader reads from r until the total number of bytes read
+// through it, across all values of r, exceeds the budget.
+type budgetReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, fileserver.Error(http.StatusRequestEntityTooLarge, errors.New("archive unpacks to too much data"))
+	}
+	return n, err
+}
@@ -0,0 +1,168 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"iupload/archive"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnpackConfinement(t *testing.T) {
+	u := newTestUpload(t)
+	outside := filepath.Join(filepath.Dir(u.Root), "outside")
+
+	tests := []struct {
+		entry  string
+		status int // of the entry's result
+		want   string
+	}{
+		{"ok/a.txt", http.StatusOK, "ok/a.txt"},
+		{"../evil.txt", http.StatusForbidden, ""},
+		{"ok/../../evil.txt", http.StatusForbidden, ""},
+		{`..\evil.txt`, http.StatusForbidden, ""},
+		{"/abs.txt", http.StatusBadRequest, ""},
+		{"escape/evil.txt", http.StatusForbidden, ""},
+		{"link", http.StatusForbidden, ""},
+		{".iupload/evil.txt", http.StatusForbidden, ""},
+	}
+
+	name := filepath.Join(t.TempDir(), "a.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, tt := range tests {
+		w, err := zw.Create(tt.entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("payload"))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	results, err := u.unpack(name, archive.Zip, "", ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(tests) {
+		t.Fatalf("got %d results, want %d", len(results), len(tests))
+	}
+	for i, tt := range tests {
+		res := results[i]
+		status := res.status
+		if res.Error == "" {
+			status = http.StatusOK
+		}
+		if status != tt.status || res.Path != tt.want {
+			t.Errorf("entry %q: path %q, status %d (%s); want %q, %d", tt.entry, res.Path, status, res.Error, tt.want, tt.status)
+		}
+	}
+
+	for _, name := range []string{"evil.txt", "abs.txt"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(u.Root), name)); err == nil {
+			t.Errorf("%s was extracted outside of the root", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil.txt")); err == nil {
+		t.Error("evil.txt was extracted through a symbolic link")
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "x" {
+		t.Error("the target of a symbolic link was overwritten")
+	}
+}
+
+func TestUnpackSkipsLinks(t *testing.T) {
+	u := newTestUpload(t)
+	name := filepath.Join(t.TempDir(), "a.tar")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+	tw.WriteHeader(&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../outside/secret"})
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	results, err := u.unpack(name, archive.Tar, "", ConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if res.Error == "" {
+			t.Errorf("link %s was extracted", res.Name)
+		}
+		if _, err := os.Lstat(filepath.Join(u.Root, res.Name)); err == nil {
+			t.Errorf("%s exists in the root", res.Name)
+		}
+	}
+}
+
+func TestUnpackLimits(t *testing.T) {
+	u := newTestUpload(t)
+	u.ExtractMaxEntries = 2
+	name := filepath.Join(t.TempDir(), "a.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, entry := range []string{"a", "b", "c"} {
+		w, _ := zw.Create(entry)
+		w.Write([]byte(entry))
+	}
+	zw.Close()
+	f.Close()
+
+	_, err = u.unpack(name, archive.Zip, "", ConflictOverwrite)
+	if status := statusOf(err); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d (%v)", status, http.StatusRequestEntityTooLarge, err)
+	}
+	for _, entry := range []string{"a", "b", "c"} {
+		if _, err := os.Stat(filepath.Join(u.Root, entry)); err == nil {
+			t.Errorf("%s was left behind", entry)
+		}
+	}
+}
+
+func TestUnpackKeepsOverwrittenFiles(t *testing.T) {
+	u := newTestUpload(t)
+	if err := os.WriteFile(filepath.Join(u.Root, "a"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "a.tar")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a good entry followed by a truncated one
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "a", Mode: 0o644, Size: 3})
+	tw.Write([]byte("new"))
+	tw.WriteHeader(&tar.Header{Name: "b", Mode: 0o644, Size: 100})
+	tw.Write([]byte("short"))
+	tw.Flush()
+	f.Close()
+
+	if _, err := u.unpack(name, archive.Tar, "", ConflictOverwrite); err == nil {
+		t.Fatal("truncated archive was unpacked")
+	}
+	if data, _ := os.ReadFile(filepath.Join(u.Root, "a")); string(data) != "old" {
+		t.Errorf("existing file changed to %q", data)
+	}
+	entries, _ := os.ReadDir(u.Root)
+	for _, entry := range entries {
+		if name := entry.Name(); name != "a" && name != "escape" && name != "link" {
+			t.Errorf("%s was left behind", name)
+		}
+	}
+}
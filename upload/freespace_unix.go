@@ -0,0 +1,15 @@
+//go:build unix
+
+package upload
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the number of bytes available to unprivileged
+// users on the file system holding dir.
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
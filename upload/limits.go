@@ -0,0 +1,134 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+
+	"github.com/dustin/go-humanize"
+)
+
+// spaceCheckInterval is how many bytes may be written between
+// two checks of the free disk space.
+const spaceCheckInterval = 16 << 20
+
+var (
+	errFileTooLarge    = errors.New("file is too large")
+	errRequestTooLarge = errors.New("request is too large")
+	errNoSpace         = errors.New("not enough free disk space")
+)
+
+// limitRequest rejects requests whose body is known to exceed
+// MaxRequestSize and makes sure reading any other body fails
+// once it does.
+func (u *Upload) limitRequest(w http.ResponseWriter, r *http.Request) error {
+	if u.MaxRequestSize <= 0 {
+		return nil
+	}
+	if r.ContentLength > u.MaxRequestSize {
+		return fileserver.Error(http.StatusRequestEntityTooLarge, errRequestTooLarge)
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, u.MaxRequestSize)
+	return nil
+}
+
+// checkFileSize rejects files known to exceed MaxFileSize.
+func (u *Upload) checkFileSize(size int64) error {
+	if u.MaxFileSize > 0 && size > u.MaxFileSize {
+		return fileserver.Error(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("%w: limit is %s", errFileTooLarge, humanize.IBytes(uint64(u.MaxFileSize))))
+	}
+	return nil
+}
+
+// checkSpace rejects uploads of size bytes that would leave less
+// than MinFreeSpace on the file system holding Root.
+func (u *Upload) checkSpace(size int64) error {
+	if u.MinFreeSpace <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(u.Root, 0o755); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	free, err := freeSpace(u.Root)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if free-size < u.MinFreeSpace {
+		return fileserver.Error(http.StatusInsufficientStorage, errNoSpace)
+	}
+	return nil
+}
+
+// limitFile wraps the contents of an uploaded file so that reading
+// fails once it grows beyond MaxFileSize.
+func (u *Upload) limitFile(src io.Reader) io.Reader {
+	if u.MaxFileSize <= 0 {
+		return src
+	}
+	return &fileLimitReader{u: u, r: src, n: u.MaxFileSize}
+}
+
+type fileLimitReader struct {
+	u *Upload
+	r io.Reader
+	n int64 // bytes left before the limit is hit
+}
+
+func (l *fileLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// the limit is only exceeded if there is more to come
+		var probe [1]byte
+		n, err := l.r.Read(probe[:])
+		if n > 0 {
+			return 0, l.u.checkFileSize(l.u.MaxFileSize + 1)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// guardSpace wraps dst so that writing fails with 507 Insufficient
+// Storage before the file system holding Root drops below
+// MinFreeSpace.
+func (u *Upload) guardSpace(dst io.Writer) io.Writer {
+	if u.MinFreeSpace <= 0 {
+		return dst
+	}
+	return &spaceGuard{u: u, w: dst, unchecked: spaceCheckInterval}
+}
+
+type spaceGuard struct {
+	u         *Upload
+	w         io.Writer
+	unchecked int64 // bytes written since the last check
+}
+
+func (g *spaceGuard) Write(p []byte) (int, error) {
+	g.unchecked += int64(len(p))
+	if g.unchecked >= spaceCheckInterval {
+		if err := g.u.checkSpace(spaceCheckInterval); err != nil {
+			return 0, err
+		}
+		g.unchecked = int64(len(p))
+	}
+	return g.w.Write(p)
+}
+
+// sizeError turns errors caused by exceeding MaxRequestSize
+// into 413 Request Entity Too Large.
+func sizeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return fileserver.Error(http.StatusRequestEntityTooLarge, errRequestTooLarge)
+	}
+	return err
+}
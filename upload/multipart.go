@@ -0,0 +1,211 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iupload/archive"
+	"iupload/digest"
+	"iupload/fileserver"
+	"log"
+	"maps"
+	"mime"
+	"net/http"
+	"net/textproto"
+)
+
+// Result describes what happened to one file of an upload.
+type Result struct {
+	// The form field the file was sent in.
+	Field string `json:"field,omitempty"`
+
+	// The file name as sent by the client.
+	Name string `json:"name"`
+
+	// Where the file has been stored, relative to the upload root.
+	// Depending on the conflict policy, the name may differ from
+	// the one sent by the client.
+	Path string `json:"path,omitempty"`
+
+	// The number of bytes stored.
+	Size int64 `json:"size"`
+
+	// The digests of the file, in hex, by algorithm.
+	Digests map[string]string `json:"digests,omitempty"`
+
+	// Why the file could not be stored, if it could not.
+	Error string `json:"error,omitempty"`
+
+	// For archives unpacked with the "extract" option, what
+	// happened to each entry. The archive itself is not kept.
+	Extracted []Result `json:"extracted,omitempty"`
+
+	status int
+}
+
+// ServeMultipart stores every file of a multipart form post in
+// the directory named by the "dir" query parameter, relative to
+// Root. Without it, files land in Root itself. File names may
+// contain relative directories, such as those sent for a folder
+// picked with webkitdirectory, which are recreated below the
+// target directory. The response reports the outcome per file.
+//
+// The expected digest of a file can be sent in a Content-Digest or
+// Repr-Digest header of its part, or in a "sha256" or "md5" form
+// field preceding it. Files not matching it are discarded.
+//
+// With the "extract" query parameter set, zip and tar archives are
+// unpacked into the target directory instead of being stored.
+//
+// The request body is read part by part and each file is streamed
+// straight to disk next to its destination, so neither memory nor
+// temporary space elsewhere grows with the size of the upload.
+func (u *Upload) ServeMultipart(w http.ResponseWriter, r *http.Request) error {
+	if err := u.Authorize(r); err != nil {
+		return err
+	}
+	if err := u.limitRequest(w, r); err != nil {
+		return err
+	}
+	if err := u.checkSpace(max(r.ContentLength, 0)); err != nil {
+		return err
+	}
+
+	dir := r.URL.Query().Get("dir")
+	if _, err := u.resolveDir(dir); err != nil {
+		return err
+	}
+	policy, err := u.conflictPolicy(r)
+	if err != nil {
+		return err
+	}
+	extract := extractRequested(r)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+
+	var results []Result
+	status := http.StatusOK
+	fieldSums := make(digest.Sums) // from form fields, for the next file
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fileserver.Error(http.StatusBadRequest, sizeError(err))
+		}
+		if part.FileName() == "" {
+			// not a file, but maybe the digest of the next one
+			if alg := digest.Algorithm(part.FormName()); alg != "" {
+				value, err := io.ReadAll(io.LimitReader(part, 1024))
+				if err != nil {
+					return fileserver.Error(http.StatusBadRequest, sizeError(err))
+				}
+				if fieldSums[alg], err = digest.ParseValue(string(value)); err != nil {
+					return fileserver.Error(http.StatusBadRequest, err)
+				}
+			}
+			part.Close()
+			continue
+		}
+
+		expect, err := partDigests(part.Header, fieldSums)
+		if err != nil {
+			return fileserver.Error(http.StatusBadRequest, err)
+		}
+		fieldSums = make(digest.Sums)
+
+		name := partFilename(part.Header, part.FileName())
+		log.Printf("Received %s=%s\n", part.FormName(), name)
+		res := u.saveFile(dir, name, policy, extract, expect, part)
+		res.Field = part.FormName()
+		part.Close()
+		if res.status == http.StatusRequestEntityTooLarge || res.status == http.StatusInsufficientStorage {
+			// stop here rather than receive the rest for nothing
+			return fileserver.Error(res.status, errors.New(res.Error))
+		}
+		if res.Error != "" && status == http.StatusOK {
+			status = res.status
+		}
+		results = append(results, res)
+	}
+
+	message := "uploaded successfully!"
+	if status != http.StatusOK {
+		message = "some files could not be uploaded"
+	}
+	return writeJSON(w, status, map[string]any{
+		"message": message,
+		"files":   results,
+	})
+}
+
+// saveFile streams an uploaded file to name below dir, or unpacks
+// it there if extract is set and it is an archive.
+func (u *Upload) saveFile(dir, name, policy string, extract bool, expect digest.Sums, src io.Reader) Result {
+	res := Result{Name: name}
+	format := ""
+	if extract {
+		format = archive.Detect(name)
+	}
+	dst, err := u.resolveFile(dir, name)
+	if err == nil && policy == ConflictReject && format == "" {
+		// don't bother receiving a file that will be rejected anyway
+		var exists bool
+		if exists, err = fileExists(dst); exists {
+			err = fileserver.Error(http.StatusConflict, fmt.Errorf("%s already exists", name))
+		}
+	}
+	var sums digest.Sums
+	if err == nil && format != "" {
+		res.Size, sums, res.Extracted, err = u.extractFile(dst, format, policy, expect, src)
+	} else if err == nil {
+		if dst, res.Size, sums, err = u.writeFile(dst, policy, expect, src); err == nil {
+			res.Path = u.reportPath(dst)
+		}
+	}
+	if err != nil {
+		res.Error, res.status = errorStatus(err)
+		return res
+	}
+	res.Digests = sums.Hex()
+	return res
+}
+
+// partDigests returns the digests expected for the file in a form
+// part, combining those in its header with the ones from form fields.
+func partDigests(header textproto.MIMEHeader, fieldSums digest.Sums) (digest.Sums, error) {
+	expect := make(digest.Sums)
+	for _, field := range []string{"Repr-Digest", "Content-Digest"} {
+		sums, err := digest.ParseHeader(header.Get(field))
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(expect, sums)
+	}
+	maps.Copy(expect, fieldSums)
+	return expect, nil
+}
+
+// partFilename returns the file name of a form part exactly as the
+// client sent it. The multipart package strips everything but the
+// last path element, which would flatten uploaded directory trees.
+func partFilename(header textproto.MIMEHeader, fallback string) string {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil || params["filename"] == "" {
+		return fallback
+	}
+	return params["filename"]
+}
+
+// errorStatus returns the message and HTTP status code for err.
+func errorStatus(err error) (string, int) {
+	var he fileserver.HandlerError
+	if errors.As(err, &he) && he.Err != nil {
+		return he.Err.Error(), he.StatusCode
+	}
+	return err.Error(), http.StatusInternalServerError
+}
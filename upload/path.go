@@ -0,0 +1,152 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errOutsideRoot is returned for upload targets that would end
+// up outside of the upload root.
+var errOutsideRoot = errors.New("target is outside of the upload root")
+
+// resolveDir validates dir, a slash-separated directory relative
+// to Root, and returns its location on disk. Missing directories
+// are created. Paths that climb out of Root, either with ".."
+// elements or through symbolic links, are rejected.
+func (u *Upload) resolveDir(dir string) (string, error) {
+	for _, elem := range strings.FieldsFunc(dir, isSlash) {
+		if elem == ".." {
+			return "", fileserver.Error(http.StatusForbidden, errOutsideRoot)
+		}
+	}
+	rel := path.Clean("/" + filepath.ToSlash(dir))[1:]
+	if state := u.StateDirName(); rel == state || strings.HasPrefix(rel, state+"/") {
+		return "", fileserver.Error(http.StatusForbidden, fmt.Errorf("%s is reserved", state))
+	}
+
+	target := fileserver.SanitizedPathJoin(u.Root, rel)
+	if err := u.checkInsideRoot(target); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return "", fileserver.Error(http.StatusInternalServerError, err)
+	}
+	return target, nil
+}
+
+// checkInsideRoot makes sure that target, after following any
+// symbolic links in the part of it that already exists, is
+// still located inside Root.
+func (u *Upload) checkInsideRoot(target string) error {
+	if err := os.MkdirAll(u.Root, 0o755); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	root, err := filepath.EvalSymlinks(u.Root)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+
+	existing := target
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fileserver.Error(http.StatusInternalServerError, err)
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return fileserver.Error(http.StatusForbidden, err)
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return fileserver.Error(http.StatusForbidden, errOutsideRoot)
+	}
+	return nil
+}
+
+// StateDirName returns the name of the directory holding
+// partial uploads, relative to Root, which should be hidden
+// from listings.
+func (u *Upload) StateDirName() string {
+	if u.StateDir == "" {
+		return defaultStateDir
+	}
+	return path.Clean("/" + filepath.ToSlash(u.StateDir))[1:]
+}
+
+// resolveFile validates name, a client-supplied file name that
+// may carry a relative directory part like "dist/js/app.js", and
+// returns its location on disk below dir, which is relative to
+// Root. Missing parent directories are created. Absolute names,
+// ".." elements and symbolic links leading out of Root are
+// rejected, and so is writing through an existing symbolic link.
+func (u *Upload) resolveFile(dir, name string) (string, error) {
+	name, err := cleanRelName(name)
+	if err != nil {
+		return "", err
+	}
+	if name == "." {
+		return "", fileserver.Error(http.StatusBadRequest, errors.New("missing file name"))
+	}
+
+	parent, err := u.resolveDir(path.Join(dir, path.Dir(name)))
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(parent, path.Base(name))
+	if info, err := os.Lstat(dst); err == nil && isSymlink(info) {
+		return "", fileserver.Error(http.StatusForbidden, fmt.Errorf("%s is a symbolic link", name))
+	}
+	return dst, nil
+}
+
+// cleanRelName checks that name, a client-supplied file name, is
+// relative and does not climb up with ".." elements, and returns it
+// cleaned and with slashes as separators.
+func cleanRelName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || len(name) >= 2 && name[1] == ':' {
+		return "", fileserver.Error(http.StatusBadRequest, fmt.Errorf("absolute file name %q", name))
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fileserver.Error(http.StatusForbidden, errOutsideRoot)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+// relPath returns the slash-separated path of dst relative to Root,
+// for reporting where a file has been stored.
+func (u *Upload) relPath(dst string) string {
+	rel, err := filepath.Rel(u.Root, dst)
+	if err != nil {
+		return filepath.Base(dst)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// reportPath returns the path of dst as clients see it, relative
+// to Root and below Prefix.
+func (u *Upload) reportPath(dst string) string {
+	return strings.TrimPrefix(path.Join(u.Prefix, u.relPath(dst)), "/")
+}
+
+func isSymlink(info fs.FileInfo) bool {
+	return info.Mode()&fs.ModeSymlink != 0
+}
+
+func isSlash(r rune) bool {
+	return r == '/' || r == '\\'
+}
@@ -0,0 +1,136 @@
+package upload
+
+import (
+	"errors"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// statusOf returns the status code that err would be answered with.
+func statusOf(err error) int {
+	var he fileserver.HandlerError
+	if errors.As(err, &he) {
+		return he.StatusCode
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// newTestUpload returns an Upload into a fresh root, next to a
+// directory called "outside" that a symbolic link "escape" in the
+// root points to.
+func newTestUpload(t *testing.T) *Upload {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return &Upload{Root: root}
+}
+
+func TestCleanRelName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		status int
+	}{
+		{"a.txt", "a.txt", http.StatusOK},
+		{"dist/js/app.js", "dist/js/app.js", http.StatusOK},
+		{"./a//b/", "a/b", http.StatusOK},
+		{`dist\js\app.js`, "dist/js/app.js", http.StatusOK},
+		{"/etc/passwd", "", http.StatusBadRequest},
+		{`\etc\passwd`, "", http.StatusBadRequest},
+		{"C:/Windows/win.ini", "", http.StatusBadRequest},
+		{"../a.txt", "", http.StatusForbidden},
+		{"a/../../b", "", http.StatusForbidden},
+		{`a\..\..\b`, "", http.StatusForbidden},
+		{"..", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		got, err := cleanRelName(tt.name)
+		if status := statusOf(err); status != tt.status || got != tt.want {
+			t.Errorf("cleanRelName(%q) = %q, %d; want %q, %d", tt.name, got, status, tt.want, tt.status)
+		}
+	}
+}
+
+func TestResolveDir(t *testing.T) {
+	u := newTestUpload(t)
+	tests := []struct {
+		dir    string
+		want   string // relative to Root
+		status int
+	}{
+		{"", ".", http.StatusOK},
+		{"builds/v1", "builds/v1", http.StatusOK},
+		{"/builds/v2/", "builds/v2", http.StatusOK},
+		{"../outside", "", http.StatusForbidden},
+		{"builds/../../outside", "", http.StatusForbidden},
+		{`builds\..\..`, "", http.StatusForbidden},
+		{"escape", "", http.StatusForbidden},
+		{"escape/sub", "", http.StatusForbidden},
+		{".iupload", "", http.StatusForbidden},
+		{".iupload/tus", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		got, err := u.resolveDir(tt.dir)
+		if status := statusOf(err); status != tt.status {
+			t.Errorf("resolveDir(%q): status %d, want %d (%v)", tt.dir, status, tt.status, err)
+			continue
+		}
+		if err == nil && got != filepath.Join(u.Root, tt.want) {
+			t.Errorf("resolveDir(%q) = %s, want %s", tt.dir, got, filepath.Join(u.Root, tt.want))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(u.Root), "outside", "sub")); err == nil {
+		t.Error("resolveDir created a directory through a symbolic link")
+	}
+}
+
+func TestResolveFile(t *testing.T) {
+	u := newTestUpload(t)
+	tests := []struct {
+		dir, name string
+		want      string // relative to Root
+		status    int
+	}{
+		{"", "a.txt", "a.txt", http.StatusOK},
+		{"builds", "dist/js/app.js", "builds/dist/js/app.js", http.StatusOK},
+		{"", "", "", http.StatusBadRequest},
+		{"", "/etc/passwd", "", http.StatusBadRequest},
+		{"", "../a.txt", "", http.StatusForbidden},
+		{"builds", "../../a.txt", "", http.StatusForbidden},
+		{"", "escape/a.txt", "", http.StatusForbidden},
+		{"escape", "a.txt", "", http.StatusForbidden},
+		// writing through an existing link would change its target
+		{"", "link", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		got, err := u.resolveFile(tt.dir, tt.name)
+		if status := statusOf(err); status != tt.status {
+			t.Errorf("resolveFile(%q, %q): status %d, want %d (%v)", tt.dir, tt.name, status, tt.status, err)
+			continue
+		}
+		if err == nil && got != filepath.Join(u.Root, tt.want) {
+			t.Errorf("resolveFile(%q, %q) = %s, want %s", tt.dir, tt.name, got, filepath.Join(u.Root, tt.want))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Mkdir creates the directory dir, relative to Root, along with any
+// missing parents, and returns its path as clients see it.
+func (u *Upload) Mkdir(dir string) (string, error) {
+	target, err := u.resolveDir(dir)
+	if err != nil {
+		return "", err
+	}
+	return u.reportPath(target), nil
+}
+
+// Remove removes the file or directory called name, relative to Root.
+// Directories must be empty unless recursive is set. Files that hidden
+// reports true for, given their path relative to Root, are neither
+// removed nor taken along with a directory holding them, and neither
+// are the state directory and Root itself.
+func (u *Upload) Remove(name string, recursive bool, hidden func(name string) bool) error {
+	target, err := u.CheckRemove(name, recursive, hidden)
+	if err != nil {
+		return err
+	}
+	remove := os.Remove
+	if recursive {
+		remove = os.RemoveAll
+	}
+	if err := remove(target); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+// CheckRemove returns the path of the file or directory called name,
+// relative to Root, if Remove may remove it, and the reason why not
+// otherwise. It changes nothing, so that several files can be checked
+// before any is removed.
+func (u *Upload) CheckRemove(name string, recursive bool, hidden func(name string) bool) (string, error) {
+	rel, err := cleanRelName(name)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "", fileserver.Error(http.StatusForbidden, errors.New("the root cannot be removed"))
+	}
+	if state := u.StateDirName(); rel == state || strings.HasPrefix(rel, state+"/") {
+		return "", fileserver.Error(http.StatusForbidden, fmt.Errorf("%s is reserved", state))
+	}
+	notFound := fileserver.Error(http.StatusNotFound, fmt.Errorf("%s not found", name))
+	if hidden(rel) {
+		return "", notFound
+	}
+
+	target := fileserver.SanitizedPathJoin(u.Root, rel)
+	// the target itself may be a symbolic link, which is removed
+	// rather than followed
+	if err := u.checkInsideRoot(filepath.Dir(target)); err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", notFound
+	}
+	if err != nil {
+		return "", fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if !info.IsDir() {
+		return target, nil
+	}
+
+	if !recursive {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return "", fileserver.Error(http.StatusInternalServerError, err)
+		}
+		if len(entries) > 0 {
+			return "", fileserver.Error(http.StatusConflict, fmt.Errorf("%s is not empty", name))
+		}
+	} else {
+		err := filepath.WalkDir(target, func(p string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			sub, err := filepath.Rel(target, p)
+			if err != nil {
+				return err
+			}
+			if hidden(path.Join(rel, filepath.ToSlash(sub))) {
+				return fileserver.Error(http.StatusForbidden, fmt.Errorf("%s holds files that cannot be removed", name))
+			}
+			return nil
+		})
+		var he fileserver.HandlerError
+		if errors.As(err, &he) {
+			return "", err
+		}
+		if err != nil {
+			return "", fileserver.Error(http.StatusInternalServerError, err)
+		}
+	}
+	return target, nil
+}
@@ -0,0 +1,199 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iupload/digest"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TempPrefix starts the names of files that are still being
+// written. They live next to their final location so that
+// moving them into place is an atomic rename.
+const TempPrefix = ".iupload-"
+
+// partial holds the names of the temporary files of uploads in
+// progress, for RemovePartial.
+var partial sync.Map
+
+// RemovePartial removes the temporary files of uploads that are still
+// in progress, such as those cut short when the server stops. Partial
+// tus uploads are kept for clients to resume later.
+func RemovePartial() {
+	partial.Range(func(name, _ any) bool {
+		os.Remove(name.(string))
+		partial.Delete(name)
+		return true
+	})
+}
+
+// What to do when the destination of an upload already exists.
+const (
+	// ConflictOverwrite replaces the existing file.
+	ConflictOverwrite = "overwrite"
+
+	// ConflictReject refuses the upload with 409 Conflict.
+	ConflictReject = "reject"
+
+	// ConflictRename stores the upload as "name (1).ext",
+	// "name (2).ext" and so on.
+	ConflictRename = "rename"
+
+	// ConflictKeepBoth stores the upload with the time of
+	// the upload appended to its name.
+	ConflictKeepBoth = "keep-both"
+)
+
+// conflictPolicy returns the conflict policy requested with the
+// "conflict" query parameter, falling back to the server default.
+func (u *Upload) conflictPolicy(r *http.Request) (string, error) {
+	policy := r.URL.Query().Get("conflict")
+	if policy == "" {
+		policy = u.Conflict
+	}
+	switch policy {
+	case "":
+		return ConflictOverwrite, nil
+	case ConflictOverwrite, ConflictReject, ConflictRename, ConflictKeepBoth:
+		return policy, nil
+	}
+	return "", fileserver.Error(http.StatusBadRequest, fmt.Errorf("unknown conflict policy %q", policy))
+}
+
+// writeFile streams src into a temporary file next to dst, syncs
+// it to disk and moves it into place according to policy, so that
+// no one ever sees a partially written file under the final name.
+// Memory use does not depend on the size of the file. The digests
+// of the file are computed on the way and, if the client sent any,
+// compared to the expected ones. It returns where the file has been
+// stored along with its size and digests.
+func (u *Upload) writeFile(dst, policy string, expect digest.Sums, src io.Reader) (string, int64, digest.Sums, error) {
+	tmp, n, sums, err := u.writeTemp(filepath.Dir(dst), expect, src)
+	if err != nil {
+		return "", n, nil, err
+	}
+	defer partial.Delete(tmp)
+	if dst, err = u.place(tmp, dst, policy); err != nil {
+		os.Remove(tmp)
+		return "", n, nil, err
+	}
+	if u.Digests != nil {
+		u.Digests.Put(dst, sums)
+	}
+	return dst, n, sums, nil
+}
+
+// writeTemp streams src into a new temporary file in dir, enforcing
+// the size limits and verifying the expected digests. It returns the
+// name of the temporary file along with the size and digests of its
+// contents. On error, the temporary file is removed.
+func (u *Upload) writeTemp(dir string, expect digest.Sums, src io.Reader) (string, int64, digest.Sums, error) {
+	tmp, err := os.CreateTemp(dir, TempPrefix+"*")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	partial.Store(tmp.Name(), nil)
+	hash := digest.New()
+	n, err := io.Copy(io.MultiWriter(u.guardSpace(tmp), hash), u.limitFile(src))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	err = errors.Join(sizeError(err), tmp.Close())
+	sums := hash.Sums()
+	if err == nil {
+		if verifyErr := sums.Verify(expect); verifyErr != nil {
+			err = fileserver.Error(http.StatusBadRequest, verifyErr)
+		}
+	}
+	if err == nil {
+		// temporary files are created private
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		partial.Delete(tmp.Name())
+		return "", n, nil, err
+	}
+	return tmp.Name(), n, sums, nil
+}
+
+// place renames the finished file src to dst, or to another name
+// next to it if dst exists and policy says to keep both. The
+// directory is synced afterwards so that the new name survives a
+// crash once the client has been told the file is stored.
+func (u *Upload) place(src, dst, policy string) (string, error) {
+	// checking for an existing file and renaming must not interleave
+	// with other uploads to the same name
+	placeMu.Lock()
+	defer placeMu.Unlock()
+
+	if policy != ConflictOverwrite {
+		exists, err := fileExists(dst)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			switch policy {
+			case ConflictReject:
+				return "", fileserver.Error(http.StatusConflict, fmt.Errorf("%s already exists", filepath.Base(dst)))
+			case ConflictRename:
+				dst, err = freeName(dst, "")
+			case ConflictKeepBoth:
+				dst, err = freeName(dst, time.Now().Format("20060102-150405"))
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// freeName returns the first name next to dst that does not exist
+// yet, made by inserting suffix and, if that is taken or empty, a
+// counter before the extension.
+func freeName(dst, suffix string) (string, error) {
+	dir, name := filepath.Split(dst)
+	ext := filepath.Ext(name)
+	if strings.HasSuffix(strings.ToLower(name), ".tar"+ext) {
+		ext = name[len(name)-len(".tar"+ext):]
+	}
+	base := strings.TrimSuffix(name, ext)
+	if suffix != "" {
+		base += "_" + suffix
+		candidate := filepath.Join(dir, base+ext)
+		exists, err := fileExists(candidate)
+		if err != nil || !exists {
+			return candidate, err
+		}
+	}
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		exists, err := fileExists(candidate)
+		if err != nil || !exists {
+			return candidate, err
+		}
+	}
+}
+
+func fileExists(name string) (bool, error) {
+	_, err := os.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
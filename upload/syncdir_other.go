@@ -0,0 +1,9 @@
+//go:build !unix
+
+package upload
+
+// syncDir does nothing on this platform, where directories cannot
+// be synced and renames are made durable by the file system.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package upload
+
+import "os"
+
+// syncDir flushes the entries of dir to disk, so that files renamed
+// into it stay there after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,545 @@
+package upload
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iupload/archive"
+	"iupload/digest"
+	"iupload/fileserver"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	// TusVersion is the version of the tus protocol spoken by the server.
+	TusVersion = "1.0.0"
+
+	tusExtensions  = "creation,termination"
+	tusContentType = "application/offset+octet-stream"
+)
+
+// tusInfo is the metadata stored next to the data of a partial upload.
+// The current offset is not stored; it is the size of the data file,
+// which stays correct even if the server dies in the middle of a write.
+type tusInfo struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Filename string            `json:"filename"`
+	Dir      string            `json:"dir,omitempty"`
+	Conflict string            `json:"conflict"`
+	Digests  digest.Sums       `json:"digests,omitempty"`
+	Extract  bool              `json:"extract,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Created  time.Time         `json:"created"`
+
+	// The state of the digests of the data up to HashedTo, kept so
+	// that they needn't be computed from the whole file at the end.
+	// If the data has moved on without it, as when the server died
+	// in the middle of a write, what is missing is read back instead.
+	HashState []byte `json:"hash_state,omitempty"`
+	HashedTo  int64  `json:"hashed_to,omitempty"`
+}
+
+// IsTus reports whether r is a tus protocol request, as opposed
+// to a plain multipart form upload.
+func IsTus(r *http.Request) bool {
+	return r.Header.Get("Tus-Resumable") != "" || r.Method == http.MethodOptions
+}
+
+// ServeTus implements the core tus protocol together with the
+// creation and termination extensions. Requests for an existing
+// upload carry its ID as the last element of the URL path.
+func (u *Upload) ServeTus(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Tus-Resumable", TusVersion)
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", TusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if u.MaxFileSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(u.MaxFileSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if err := u.Authorize(r); err != nil {
+		return err
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != TusVersion {
+		w.Header().Set("Tus-Version", TusVersion)
+		return fileserver.Error(http.StatusPreconditionFailed, fmt.Errorf("unsupported tus version %q", v))
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		return u.tusCreate(w, r)
+	case http.MethodHead:
+		return u.tusHead(w, r)
+	case http.MethodPatch:
+		return u.tusPatch(w, r)
+	case http.MethodDelete:
+		return u.tusDelete(w, r)
+	}
+	return fileserver.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+}
+
+func (u *Upload) tusCreate(w http.ResponseWriter, r *http.Request) error {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return fileserver.Error(http.StatusBadRequest, fmt.Errorf("invalid Upload-Length"))
+	}
+	if err := u.checkFileSize(length); err != nil {
+		return err
+	}
+	if err := u.checkSpace(length); err != nil {
+		return err
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+	id, err := newID()
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+
+	info := &tusInfo{
+		ID:       id,
+		Length:   length,
+		Filename: meta["filename"],
+		Metadata: meta,
+		Created:  time.Now().UTC(),
+	}
+	if info.Filename == "" {
+		info.Filename = meta["name"]
+	}
+	if info.Dir, err = TusDir(r); err != nil {
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+	if _, err := u.resolveDir(info.Dir); err != nil {
+		return err
+	}
+	if info.Conflict, err = u.conflictPolicy(r); err != nil {
+		return err
+	}
+	info.Extract, _ = strconv.ParseBool(meta["extract"])
+	info.Extract = info.Extract || extractRequested(r)
+	if info.Digests, err = tusDigests(r, meta); err != nil {
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+	if info.Conflict == ConflictReject {
+		// fail early rather than after the whole file has been sent
+		if err := u.checkNotExists(info); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(u.stateDir(), 0o755); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if err := u.writeTusInfo(info); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	data, err := os.OpenFile(u.tusDataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	data.Close()
+
+	if length == 0 {
+		if err := u.tusFinish(w, info); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Location", fileserver.BasePath(r)+path.Join(r.URL.Path, id))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func (u *Upload) tusHead(w http.ResponseWriter, r *http.Request) error {
+	info, offset, err := u.loadTus(r)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (u *Upload) tusPatch(w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Content-Type") != tusContentType {
+		return fileserver.Error(http.StatusUnsupportedMediaType, fmt.Errorf("Content-Type must be %s", tusContentType))
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return fileserver.Error(http.StatusBadRequest, fmt.Errorf("invalid Upload-Offset"))
+	}
+	if err := u.limitRequest(w, r); err != nil {
+		return err
+	}
+
+	id := path.Base(r.URL.Path)
+	if !u.lock(id) {
+		return fileserver.Error(http.StatusConflict, fmt.Errorf("upload %s is busy", id))
+	}
+	defer u.unlock(id)
+
+	info, current, err := u.loadTus(r)
+	if err != nil {
+		return err
+	}
+	if offset != current {
+		return fileserver.Error(http.StatusConflict, fmt.Errorf("offset mismatch: have %d, got %d", current, offset))
+	}
+
+	h, err := u.tusHash(info, current)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	data, err := os.OpenFile(u.tusDataPath(info.ID), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	// whatever arrives before the connection drops is kept, so
+	// that the client can resume from the new offset
+	n, copyErr := io.Copy(hashWriter{u.guardSpace(data), h}, io.LimitReader(r.Body, info.Length-current))
+	syncErr := data.Sync()
+	closeErr := data.Close()
+	offset = current + n
+	if info.HashState, err = h.MarshalBinary(); err == nil {
+		info.HashedTo = offset
+	}
+	if err := errors.Join(sizeError(copyErr), syncErr, closeErr); err != nil {
+		// keep the digests of what did arrive
+		u.writeTusInfo(info)
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+
+	if offset == info.Length {
+		if err := u.tusFinish(w, info); err != nil {
+			return err
+		}
+	} else if err := u.writeTusInfo(info); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (u *Upload) tusDelete(w http.ResponseWriter, r *http.Request) error {
+	id := path.Base(r.URL.Path)
+	if !u.lock(id) {
+		return fileserver.Error(http.StatusConflict, fmt.Errorf("upload %s is busy", id))
+	}
+	defer u.unlock(id)
+
+	info, _, err := u.loadTus(r)
+	if err != nil {
+		return err
+	}
+	if err := u.removeTus(info.ID); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// tusFinish verifies the digests of a completed upload and moves
+// it from the state directory to its final location, which is
+// reported to the client in the Upload-Path header since it depends
+// on the conflict policy. Uploads not matching the expected digests,
+// or refused by the "reject" policy, are deleted. Archives uploaded
+// with the "extract" option are unpacked into the target directory
+// instead, and what happened to each entry is reported as a JSON
+// array in the Upload-Extracted header, since tus responses carry
+// no body. Archives that cannot be unpacked are deleted as well.
+func (u *Upload) tusFinish(w http.ResponseWriter, info *tusInfo) error {
+	dst, err := u.resolveFile(info.Dir, info.finalName())
+	if err != nil {
+		return err
+	}
+	sums, err := u.tusSums(info)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if err := sums.Verify(info.Digests); err != nil {
+		if err := u.removeTus(info.ID); err != nil {
+			return fileserver.Error(http.StatusInternalServerError, err)
+		}
+		return fileserver.Error(http.StatusBadRequest, err)
+	}
+	w.Header().Set("Repr-Digest", sums.Header())
+
+	if format := archive.Detect(info.finalName()); info.Extract && format != "" {
+		dir := u.relPath(filepath.Dir(dst))
+		results, err := u.unpack(u.tusDataPath(info.ID), format, dir, info.Conflict)
+		if err != nil {
+			var he fileserver.HandlerError
+			if errors.As(err, &he) && he.StatusCode < http.StatusInternalServerError {
+				// a broken or oversized archive stays broken;
+				// unpacking it again on every retry is no use
+				if err := u.removeTus(info.ID); err != nil {
+					return fileserver.Error(http.StatusInternalServerError, err)
+				}
+			}
+			return err
+		}
+		if err := u.removeTus(info.ID); err != nil {
+			return fileserver.Error(http.StatusInternalServerError, err)
+		}
+		extracted, err := headerJSON(results)
+		if err != nil {
+			return fileserver.Error(http.StatusInternalServerError, err)
+		}
+		w.Header().Set("Upload-Path", u.reportPath(filepath.Dir(dst)))
+		w.Header().Set("Upload-Extracted", extracted)
+		return nil
+	}
+
+	dst, err = u.place(u.tusDataPath(info.ID), dst, info.Conflict)
+	if err != nil {
+		var he fileserver.HandlerError
+		if errors.As(err, &he) && he.StatusCode == http.StatusConflict {
+			// a file of that name turned up meanwhile; the upload
+			// can never be placed, so it is not kept
+			if err := u.removeTus(info.ID); err != nil {
+				return fileserver.Error(http.StatusInternalServerError, err)
+			}
+		}
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if err := os.Remove(u.tusInfoPath(info.ID)); err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if u.Digests != nil {
+		u.Digests.Put(dst, sums)
+	}
+	w.Header().Set("Upload-Path", u.reportPath(dst))
+	return nil
+}
+
+// headerJSON encodes v as JSON fit for a header field value, with
+// characters outside ASCII escaped.
+func headerJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, c := range string(data) {
+		switch {
+		case c < utf8.RuneSelf:
+			b.WriteRune(c)
+		case c > 0xFFFF:
+			r1, r2 := utf16.EncodeRune(c)
+			fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+		default:
+			fmt.Fprintf(&b, `\u%04x`, c)
+		}
+	}
+	return b.String(), nil
+}
+
+// tusSums returns the digests of the data of a completed upload.
+func (u *Upload) tusSums(info *tusInfo) (digest.Sums, error) {
+	h, err := u.tusHash(info, info.Length)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sums(), nil
+}
+
+// tusHash returns the hash of the first offset bytes of the data of
+// a partial upload: the state kept in info if it is that far, or
+// else one computed from the data file.
+func (u *Upload) tusHash(info *tusInfo, offset int64) (*digest.Hash, error) {
+	h := digest.New()
+	if info.HashedTo == offset && h.UnmarshalBinary(info.HashState) == nil {
+		return h, nil
+	}
+	h = digest.New()
+	data, err := os.Open(u.tusDataPath(info.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	if _, err := io.CopyN(h, data, offset); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// hashWriter writes to w and hashes what was written.
+type hashWriter struct {
+	w io.Writer
+	h *digest.Hash
+}
+
+func (hw hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	return n, err
+}
+
+// tusDigests returns the digests expected for a whole upload, taken
+// from the Repr-Digest header of the creation request or from upload
+// metadata named after the algorithm, like "sha256".
+func tusDigests(r *http.Request, meta map[string]string) (digest.Sums, error) {
+	sums, err := digest.ParseHeader(r.Header.Get("Repr-Digest"))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range meta {
+		if alg := digest.Algorithm(key); alg != "" {
+			if sums[alg], err = digest.ParseValue(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sums, nil
+}
+
+// checkNotExists returns 409 Conflict if the final location
+// of the upload is already taken.
+func (u *Upload) checkNotExists(info *tusInfo) error {
+	dst, err := u.resolveFile(info.Dir, info.finalName())
+	if err != nil {
+		return err
+	}
+	exists, err := fileExists(dst)
+	if err != nil {
+		return fileserver.Error(http.StatusInternalServerError, err)
+	}
+	if exists {
+		return fileserver.Error(http.StatusConflict, fmt.Errorf("%s already exists", info.finalName()))
+	}
+	return nil
+}
+
+// finalName returns the name the upload is stored under.
+func (info *tusInfo) finalName() string {
+	if info.Filename == "" {
+		return info.ID
+	}
+	return info.Filename
+}
+
+// loadTus returns the partial upload addressed by r
+// along with the number of bytes received so far.
+func (u *Upload) loadTus(r *http.Request) (*tusInfo, int64, error) {
+	id := path.Base(r.URL.Path)
+	if !validID(id) {
+		return nil, 0, fileserver.Error(http.StatusNotFound, fmt.Errorf("unknown upload %q", id))
+	}
+	buf, err := os.ReadFile(u.tusInfoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, fileserver.Error(http.StatusNotFound, fmt.Errorf("unknown upload %q", id))
+	}
+	if err != nil {
+		return nil, 0, fileserver.Error(http.StatusInternalServerError, err)
+	}
+	info := new(tusInfo)
+	if err := json.Unmarshal(buf, info); err != nil {
+		return nil, 0, fileserver.Error(http.StatusInternalServerError, err)
+	}
+	stat, err := os.Stat(u.tusDataPath(id))
+	if err != nil {
+		return nil, 0, fileserver.Error(http.StatusInternalServerError, err)
+	}
+	return info, stat.Size(), nil
+}
+
+// writeTusInfo stores info, replacing what was stored before in one
+// go, since it is rewritten with every PATCH request.
+func (u *Upload) writeTusInfo(info *tusInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := u.tusInfoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.tusInfoPath(info.ID))
+}
+
+func (u *Upload) removeTus(id string) error {
+	return errors.Join(os.Remove(u.tusDataPath(id)), os.Remove(u.tusInfoPath(id)))
+}
+
+func (u *Upload) tusDataPath(id string) string {
+	return filepath.Join(u.stateDir(), id+".bin")
+}
+
+// TusDir returns the target directory of a tus creation request.
+// It comes from the "dir" query parameter like for multipart
+// uploads or, without it, from the upload metadata.
+func TusDir(r *http.Request) (string, error) {
+	if query := r.URL.Query(); query.Has("dir") {
+		return query.Get("dir"), nil
+	}
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	return meta["dir"], err
+}
+
+// HasTus reports whether id names a partial upload kept by u.
+func (u *Upload) HasTus(id string) bool {
+	if !validID(id) {
+		return false
+	}
+	_, err := os.Stat(u.tusInfoPath(id))
+	return err == nil
+}
+
+func (u *Upload) tusInfoPath(id string) string {
+	return filepath.Join(u.stateDir(), id+".json")
+}
+
+// validID reports whether id looks like one returned by newID,
+// so that it is safe to use as a file name.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, which is a
+// comma-separated list of keys each optionally followed by a space
+// and a base64-encoded value.
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata: empty key")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q: %v", key, err)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
@@ -0,0 +1,176 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tusRequest sends a tus request to u and returns the response, with
+// errors answered as the server would.
+func tusRequest(t *testing.T, u *Upload, method, target string, header map[string]string, body string) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Tus-Resumable", TusVersion)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	if err := u.ServeTus(w, r); err != nil {
+		w.Code = statusOf(err)
+	}
+	return w.Result()
+}
+
+// tusCreate creates an upload of the given length and returns its
+// URL path.
+func tusCreate(t *testing.T, u *Upload, name string, length int, header map[string]string) string {
+	t.Helper()
+	h := map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(name)),
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	resp := tusRequest(t, u, http.MethodPost, "/_upload", h, "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating upload: status %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+func tusPatch(t *testing.T, u *Upload, location string, offset int, data string) *http.Response {
+	t.Helper()
+	return tusRequest(t, u, http.MethodPatch, location, map[string]string{
+		"Content-Type":  tusContentType,
+		"Upload-Offset": strconv.Itoa(offset),
+	}, data)
+}
+
+func TestTusOffsets(t *testing.T) {
+	u := &Upload{Root: t.TempDir()}
+	const data = "0123456789"
+	location := tusCreate(t, u, "a.txt", len(data), nil)
+
+	steps := []struct {
+		offset     int
+		chunk      string
+		status     int
+		wantOffset string
+	}{
+		{3, data[3:6], http.StatusConflict, ""}, // ahead of the data
+		{0, data[0:4], http.StatusNoContent, "4"},
+		{0, data[0:4], http.StatusConflict, ""}, // sent again
+		{2, data[2:8], http.StatusConflict, ""}, // overlapping
+		{8, data[8:], http.StatusConflict, ""},  // skipping a chunk
+		{-1, data[4:], http.StatusBadRequest, ""},
+		{4, data[4:7], http.StatusNoContent, "7"},
+		{7, data[7:] + "extra", http.StatusNoContent, "10"}, // cut at the length
+	}
+	for i, s := range steps {
+		resp := tusPatch(t, u, location, s.offset, s.chunk)
+		if resp.StatusCode != s.status {
+			t.Fatalf("step %d: PATCH at %d: status %d, want %d", i, s.offset, resp.StatusCode, s.status)
+		}
+		if got := resp.Header.Get("Upload-Offset"); s.wantOffset != "" && got != s.wantOffset {
+			t.Fatalf("step %d: Upload-Offset %s, want %s", i, got, s.wantOffset)
+		}
+		if s.status != http.StatusNoContent || s.wantOffset == "10" {
+			continue
+		}
+		head := tusRequest(t, u, http.MethodHead, location, nil, "")
+		if got := head.Header.Get("Upload-Offset"); got != s.wantOffset {
+			t.Fatalf("step %d: HEAD Upload-Offset %s, want %s", i, got, s.wantOffset)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(u.Root, "a.txt"))
+	if err != nil || string(got) != data {
+		t.Fatalf("stored %q, %v; want %q", got, err, data)
+	}
+	if resp := tusRequest(t, u, http.MethodHead, location, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("finished upload: HEAD status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestTusDigests(t *testing.T) {
+	const data = "hello, world"
+	sum := sha256.Sum256([]byte(data))
+	good := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	bad := "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":"
+
+	tests := []struct {
+		name   string
+		digest string
+		status int
+	}{
+		{"good.txt", good, http.StatusNoContent},
+		{"bad.txt", bad, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		u := &Upload{Root: t.TempDir()}
+		location := tusCreate(t, u, tt.name, len(data), map[string]string{"Repr-Digest": tt.digest})
+		// in two parts, so that the hash state is carried over
+		tusPatch(t, u, location, 0, data[:5])
+		resp := tusPatch(t, u, location, 5, data[5:])
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		_, err := os.Stat(filepath.Join(u.Root, tt.name))
+		if stored := err == nil; stored != (tt.status == http.StatusNoContent) {
+			t.Errorf("%s: stored %v", tt.name, stored)
+		}
+		if entries, _ := os.ReadDir(u.stateDir()); len(entries) > 0 {
+			t.Errorf("%s: %d files left in the state directory", tt.name, len(entries))
+		}
+	}
+
+	u := &Upload{Root: t.TempDir()}
+	resp := tusRequest(t, u, http.MethodPost, "/_upload", map[string]string{
+		"Upload-Length": "1",
+		"Repr-Digest":   "sha-512=:AAAA:",
+	}, "")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsupported digest: status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestTusRejectAtFinish(t *testing.T) {
+	u := &Upload{Root: t.TempDir(), Conflict: ConflictReject}
+	location := tusCreate(t, u, "a.txt", 3, nil)
+	// the file turns up after the upload was created
+	if err := os.WriteFile(filepath.Join(u.Root, "a.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if resp := tusPatch(t, u, location, 0, "new"); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if resp := tusRequest(t, u, http.MethodHead, location, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("refused upload: HEAD status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if data, _ := os.ReadFile(filepath.Join(u.Root, "a.txt")); string(data) != "old" {
+		t.Errorf("existing file changed to %q", data)
+	}
+}
+
+func TestTusDropsBrokenArchive(t *testing.T) {
+	u := &Upload{Root: t.TempDir()}
+	const data = "not a zip file"
+	location := tusCreate(t, u, "a.zip", len(data), map[string]string{
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.zip")) +
+			",extract " + base64.StdEncoding.EncodeToString([]byte("true")),
+	})
+	if resp := tusPatch(t, u, location, 0, data); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	if resp := tusRequest(t, u, http.MethodHead, location, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("broken archive: HEAD status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
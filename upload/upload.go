@@ -0,0 +1,144 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iupload/auth"
+	"iupload/digest"
+	"iupload/fileserver"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+// defaultStateDir is where in-progress uploads are tracked,
+// relative to the upload root.
+const defaultStateDir = ".iupload"
+
+// Upload accepts files into Root. Besides plain multipart form
+// posts it speaks the tus resumable upload protocol, keeping
+// partial uploads on disk so clients can pick up where they
+// left off after a dropped connection.
+type Upload struct {
+	// The directory that finished uploads are stored in.
+	Root string `json:"root,omitempty"`
+
+	// The directory, relative to Root, in which partial uploads
+	// are kept until they are complete. Default: ".iupload"
+	StateDir string `json:"state_dir,omitempty"`
+
+	// What to do when an uploaded file already exists: "overwrite",
+	// "reject", "rename" or "keep-both". Clients can choose for
+	// themselves with the "conflict" query parameter.
+	// Default: "overwrite"
+	Conflict string `json:"conflict,omitempty"`
+
+	// The maximum size of a single uploaded file in bytes. Zero
+	// means no limit.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// The maximum size of the body of an upload request in bytes.
+	// Zero means no limit.
+	MaxRequestSize int64 `json:"max_request_size,omitempty"`
+
+	// The number of bytes that must stay free on the file system
+	// holding Root. Uploads that would eat into it are refused
+	// with 507 Insufficient Storage. Zero disables the check.
+	MinFreeSpace int64 `json:"min_free_space,omitempty"`
+
+	// Limits for unpacking archives uploaded with the "extract"
+	// option, guarding against archive bombs: the maximum number of
+	// entries and the maximum total size of the unpacked files in
+	// bytes. Defaults: 10000 entries and 10 GiB.
+	ExtractMaxEntries int   `json:"extract_max_entries,omitempty"`
+	ExtractMaxSize    int64 `json:"extract_max_size,omitempty"`
+
+	// The users, identified by their client certificates, who may
+	// upload files. Empty lets everyone upload.
+	Users []string `json:"users,omitempty"`
+
+	// Allow the users who may upload files to also create directories
+	// with /_mkdir and remove files with /_rm. Removing files cannot
+	// be undone, so it is off unless asked for.
+	Manage bool `json:"manage,omitempty"`
+
+	// The path the root appears under to clients, such as that of a
+	// mount, which is included in the paths reported to them.
+	Prefix string `json:"-"`
+
+	// If set, the digests of uploaded files are remembered here
+	// so that downloads can announce them without hashing again.
+	Digests *digest.Cache `json:"-"`
+}
+
+// The locks below are shared by all Uploads, so that they hold while
+// the configuration is reloaded and requests are in flight with both
+// the old and the new one.
+var (
+	// locks serializes writes to the same partial upload.
+	locks sync.Map
+
+	// placeMu serializes moving finished files into place.
+	placeMu sync.Mutex
+)
+
+// Validate ensures u has a valid configuration.
+func (u *Upload) Validate() error {
+	switch u.Conflict {
+	case "", ConflictOverwrite, ConflictReject, ConflictRename, ConflictKeepBoth:
+	default:
+		return fmt.Errorf("unknown conflict policy %q", u.Conflict)
+	}
+	if u.MaxFileSize < 0 || u.MaxRequestSize < 0 || u.MinFreeSpace < 0 || u.ExtractMaxEntries < 0 || u.ExtractMaxSize < 0 {
+		return fmt.Errorf("size limits must not be negative")
+	}
+	return nil
+}
+
+// Authorize refuses r with 403 Forbidden unless it comes from one of
+// Users.
+func (u *Upload) Authorize(r *http.Request) error {
+	user := auth.User(r)
+	if auth.Allowed(user, u.Users) {
+		return nil
+	}
+	if user == "" {
+		return fileserver.Error(http.StatusForbidden, errors.New("a client certificate is required"))
+	}
+	return fileserver.Error(http.StatusForbidden, fmt.Errorf("%s may not upload files here", user))
+}
+
+// stateDir returns the directory holding partial uploads.
+func (u *Upload) stateDir() string {
+	return filepath.Join(u.Root, filepath.FromSlash(u.StateDirName()), "tus")
+}
+
+// lock acquires the lock for the partial upload id. It reports
+// false if another request is already holding it.
+func (u *Upload) lock(id string) bool {
+	_, busy := locks.LoadOrStore(id, struct{}{})
+	return !busy
+}
+
+func (u *Upload) unlock(id string) {
+	locks.Delete(id)
+}
+
+// newID returns a random identifier for a new upload.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeJSON writes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}